@@ -3,6 +3,7 @@ module router
 go 1.20
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.5.0
 	github.com/google/uuid v1.4.0
 	github.com/kamioair/qf v0.0.7
 	github.com/qiu-tec/easy-con.golang v0.0.9
@@ -13,7 +14,6 @@ require (
 require (
 	github.com/araddon/dateparse v0.0.0-20210429162001-6b43995a97de // indirect
 	github.com/ebitengine/purego v0.8.1 // indirect
-	github.com/eclipse/paho.mqtt.golang v1.5.0 // indirect
 	github.com/fatih/color v1.18.0 // indirect
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/go-ole/go-ole v1.2.6 // indirect
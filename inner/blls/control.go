@@ -0,0 +1,151 @@
+package blls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"router/inner/config"
+	"router/inner/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+type procItem struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+type controller struct {
+	lock  *sync.Mutex
+	procs map[string]*procItem     // process方式下由路由启动的模块进程
+	exit  func(module string) bool // 请求模块自行退出
+	probe func(module string) bool // 探测模块是否存活
+}
+
+func newControllerBll(exit, probe func(module string) bool) *controller {
+	return &controller{
+		lock:  &sync.Mutex{},
+		procs: map[string]*procItem{},
+		exit:  exit,
+		probe: probe,
+	}
+}
+
+// Do 启动、停止或重启本机模块，返回操作后的状态
+func (c *controller) Do(module, action string) (models.EModuleStatus, error) {
+	svc, ok := config.Control.Modules[module]
+	if !ok {
+		return "", models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), fmt.Sprintf("module %s is not allowed", module))
+	}
+	switch action {
+	case "Start", "Stop", "Restart":
+	default:
+		return "", errors.New(fmt.Sprintf("action %s is not supported", action))
+	}
+
+	var err error
+	if config.Control.Backend == "systemd" {
+		err = c.systemd(module, svc, action)
+	} else {
+		if action == "Stop" || action == "Restart" {
+			err = c.stop(module)
+		}
+		if action == "Start" && c.running(module) {
+			return models.EModuleRunning, nil
+		}
+		if err == nil && action != "Stop" {
+			err = c.start(module, svc)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if action == "Stop" {
+		return models.EModuleStopped, nil
+	}
+	return models.EModuleRunning, nil
+}
+
+func (c *controller) systemd(module string, svc config.ControlService, action string) error {
+	unit := svc.Unit
+	if unit == "" {
+		unit = module
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "systemctl", strings.ToLower(action), unit).CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("systemctl %s %s: %s %s", strings.ToLower(action), unit, err.Error(), strings.TrimSpace(string(out))))
+	}
+	return nil
+}
+
+func (c *controller) start(module string, svc config.ControlService) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.procs[module]; ok {
+		// 已经在运行
+		return nil
+	}
+	if svc.Path == "" {
+		return errors.New(fmt.Sprintf("module %s has no path", module))
+	}
+	cmd := exec.Command(svc.Path, svc.Args...)
+	cmd.Dir = svc.Dir
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	item := &procItem{cmd: cmd, done: make(chan struct{})}
+	c.procs[module] = item
+	go func() {
+		_ = cmd.Wait()
+		close(item.done)
+		c.lock.Lock()
+		if c.procs[module] == item {
+			delete(c.procs, module)
+		}
+		c.lock.Unlock()
+	}()
+	return nil
+}
+
+// running 判断模块是否已在运行，包括不是由路由启动的模块
+func (c *controller) running(module string) bool {
+	c.lock.Lock()
+	_, ok := c.procs[module]
+	c.lock.Unlock()
+	return ok || (c.probe != nil && c.probe(module))
+}
+
+// stop 先请求模块自行退出，超时后结束由路由启动的进程
+func (c *controller) stop(module string) error {
+	c.lock.Lock()
+	item := c.procs[module]
+	c.lock.Unlock()
+
+	exited := c.exit(module)
+	if item == nil {
+		if !exited {
+			return errors.New(fmt.Sprintf("module %s is not responding", module))
+		}
+		return nil
+	}
+	select {
+	case <-item.done:
+	case <-time.After(c.timeout()):
+		_ = item.cmd.Process.Kill()
+		<-item.done
+	}
+	return nil
+}
+
+func (c *controller) timeout() time.Duration {
+	if config.Control.Timeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(config.Control.Timeout) * time.Second
+}
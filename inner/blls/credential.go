@@ -0,0 +1,163 @@
+package blls
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/kamioair/qf/qdefine"
+	"github.com/kamioair/qf/utils/qio"
+	"router/inner/config"
+	"router/inner/models"
+	"sync"
+	"time"
+)
+
+// 更换凭证后旧凭证仍有效的时间，避免设备没收到新凭证或连接尚未重建时被拒绝
+const credentialGrace = 24 * time.Hour
+
+type credential struct {
+	lock  *sync.Mutex
+	items map[string]*models.CredentialRecord // 已签发的凭证，key为设备码
+}
+
+func newCredentialBll() *credential {
+	c := &credential{
+		lock:  &sync.Mutex{},
+		items: map[string]*models.CredentialRecord{},
+	}
+	c.load()
+	return c
+}
+
+// Issue 给设备签发新的凭证，之前的凭证立即作废
+func (c *credential) Issue(devId string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	c.items[devId] = &models.CredentialRecord{
+		DeviceId: devId,
+		Hash:     hashToken(token),
+		Time:     qdefine.NewDateTime(time.Now()),
+	}
+	c.save()
+	return token, nil
+}
+
+// Rotate 校验设备当前的凭证后更换为新凭证，旧凭证在宽限期内仍有效
+// 首个凭证只在分配设备码时签发，没有签发记录的设备不能通过更换获取凭证
+func (c *credential) Rotate(req models.CredentialCheck) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	rec, ok := c.items[req.DeviceId]
+	if !ok {
+		// 未签发、已被吊销或根路由数据丢失
+		return "", models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), "credential is not issued")
+	}
+	if !c.match(rec, req.Credential) {
+		return "", models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), "credential is invalid")
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	c.items[req.DeviceId] = &models.CredentialRecord{
+		DeviceId: req.DeviceId,
+		Hash:     hashToken(token),
+		PrevHash: rec.Hash,
+		Time:     qdefine.NewDateTime(time.Now()),
+	}
+	c.save()
+	return token, nil
+}
+
+// Verify 校验设备凭证
+func (c *credential) Verify(req models.CredentialCheck) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	rec, ok := c.items[req.DeviceId]
+	return ok && c.match(rec, req.Credential)
+}
+
+// Has 设备是否已签发凭证
+func (c *credential) Has(devId string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.items[devId]
+	return ok
+}
+
+// Revoke 吊销设备凭证，设备移除时调用
+func (c *credential) Revoke(devId string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.items[devId]; !ok {
+		return false
+	}
+	delete(c.items, devId)
+	c.save()
+	return true
+}
+
+func (c *credential) match(rec *models.CredentialRecord, token string) bool {
+	if token == "" {
+		return false
+	}
+	hash := hashToken(token)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(rec.Hash)) == 1 {
+		return true
+	}
+	if rec.PrevHash == "" || time.Since(rec.Time.ToTime()) > credentialGrace {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(rec.PrevHash)) == 1
+}
+
+func (c *credential) load() {
+	str, err := qio.ReadAllBytes(config.Credential.File)
+	if err != nil {
+		return
+	}
+	list := make([]*models.CredentialRecord, 0)
+	if json.Unmarshal(str, &list) != nil {
+		return
+	}
+	for _, rec := range list {
+		c.items[rec.DeviceId] = rec
+	}
+}
+
+func (c *credential) save() {
+	list := make([]*models.CredentialRecord, 0)
+	for _, rec := range c.items {
+		list = append(list, rec)
+	}
+	js, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return
+	}
+	_ = qio.WriteAllBytes(config.Credential.File, js, false)
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.New("generate credential failed")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,73 @@
+package blls
+
+import (
+	"github.com/kamioair/qf/qdefine"
+	"path/filepath"
+	"router/inner/config"
+	"router/inner/models"
+	"testing"
+	"time"
+)
+
+func TestCredentialMatch(t *testing.T) {
+	c := &credential{}
+	tests := []struct {
+		name  string
+		rec   models.CredentialRecord
+		token string
+		want  bool
+	}{
+		{"current", models.CredentialRecord{Hash: hashToken("new")}, "new", true},
+		{"wrong", models.CredentialRecord{Hash: hashToken("new")}, "bad", false},
+		{"empty token", models.CredentialRecord{Hash: hashToken("")}, "", false},
+		{"previous in grace", models.CredentialRecord{Hash: hashToken("new"), PrevHash: hashToken("old"), Time: qdefine.NewDateTime(time.Now())}, "old", true},
+		{"previous expired", models.CredentialRecord{Hash: hashToken("new"), PrevHash: hashToken("old"), Time: qdefine.NewDateTime(time.Now().Add(-credentialGrace - time.Hour))}, "old", false},
+		{"no previous", models.CredentialRecord{Hash: hashToken("new"), Time: qdefine.NewDateTime(time.Now())}, "old", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.match(&tt.rec, tt.token); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialRotate(t *testing.T) {
+	config.Credential.File = filepath.Join(t.TempDir(), "credentials.json")
+	c := newCredentialBll()
+	first, err := c.Issue("dev1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		req     models.CredentialCheck
+		wantErr bool
+	}{
+		{"not issued", models.CredentialCheck{DeviceId: "dev2"}, true},
+		{"not issued with token", models.CredentialCheck{DeviceId: "dev2", Credential: first}, true},
+		{"empty token", models.CredentialCheck{DeviceId: "dev1"}, true},
+		{"wrong token", models.CredentialCheck{DeviceId: "dev1", Credential: "bad"}, true},
+		{"current token", models.CredentialCheck{DeviceId: "dev1", Credential: first}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := c.Rotate(tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Rotate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (token == "" || token == tt.req.Credential) {
+				t.Errorf("Rotate() token = %q, want a new token", token)
+			}
+		})
+	}
+	if c.Verify(models.CredentialCheck{DeviceId: "dev2"}) {
+		t.Error("Rotate() issued a credential without a record")
+	}
+	// 更换后旧凭证在宽限期内仍有效
+	if !c.Verify(models.CredentialCheck{DeviceId: "dev1", Credential: first}) {
+		t.Error("previous credential should be valid in grace period")
+	}
+}
@@ -2,28 +2,50 @@ package blls
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/kamioair/qf/qdefine"
 	"router/inner/config"
 	"router/inner/daos"
 	"router/inner/models"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 type device struct {
 	monitorBll   *monitor
+	logsBll      *logs
 	lock         *sync.Mutex
 	upperDevice  models.DeviceKnock           // 上层路由设备信息
 	localDevices map[string]models.DeviceInfo // 自己路由设备缓存列表
 	alarmCaches  map[string]models.DeviceAlarm
+	driftAlarms  map[string]string // 版本漂移报警，key为设备码
+	dupAlarms    map[string]string // 设备码重复报警，key为设备码
+	claims       map[string]map[string]deviceClaim
+	rollbacks    map[string]time.Time // 正在回滚的本机模块及开始时间，回滚后的降级不报警
+	onOnline     func(devId string)   // 设备从离线恢复在线
 }
 
-func newDeviceBll() *device {
+// deviceClaim 声明使用某设备码的实例或路径
+type deviceClaim struct {
+	desc  string
+	first time.Time // 首次心跳时间
+	last  time.Time // 最后心跳时间
+}
+
+func newDeviceBll(logsBll *logs, onOnline func(devId string)) *device {
 	d := &device{
+		logsBll:      logsBll,
 		lock:         &sync.Mutex{},
 		upperDevice:  models.DeviceKnock{},
 		localDevices: map[string]models.DeviceInfo{},
 		alarmCaches:  map[string]models.DeviceAlarm{},
+		driftAlarms:  map[string]string{},
+		dupAlarms:    map[string]string{},
+		claims:       map[string]map[string]deviceClaim{},
+		rollbacks:    map[string]time.Time{},
+		onOnline:     onOnline,
 	}
 	d.monitorBll = newMonitorBll(d.onMonitorChanged, d.onHeartChanged)
 	return d
@@ -34,6 +56,8 @@ func (d *device) Start() {
 	dev := d.localDevices[config.DeviceId()]
 	dev.Id = config.DeviceId()
 	dev.Name = config.DeviceName()
+	dev.Desc = config.DeviceDesc()
+	dev.Tags = config.DeviceTags()
 	dev.Modules = models.ModuleCollection{}
 	dev.FullUrl = strings.Trim(d.upperDevice.FullUrl+"/"+dev.Id, "/")
 	sp := strings.Split(dev.FullUrl, "/")
@@ -47,13 +71,24 @@ func (d *device) Start() {
 }
 
 // AddHeart 添加下级路由发送的心跳和报警信息
-func (d *device) AddHeart(devId string, routeHearts map[string]models.DeviceAlarm) bool {
+func (d *device) AddHeart(devId string, inst models.DeviceInstance, routeHearts map[string]models.DeviceAlarm) bool {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	d.monitorBll.AddHeart(devId)
 
-	oldStr, _ := json.Marshal(d.alarmCaches)
+	oldStr, _ := json.Marshal(d.withExtraAlarms())
+	// 直接下级按实例号区分，更下级按路径区分
+	now := time.Now()
+	if inst.Instance != "" {
+		d.addClaim(devId, "i:"+inst.Instance, fmt.Sprintf("%s %s (%s)", inst.Hostname, inst.FullUrl, inst.Instance), now)
+	}
+	for k, v := range routeHearts {
+		if k != devId && v.FullUrl != "" {
+			d.addClaim(k, "u:"+v.FullUrl, v.FullUrl, now)
+		}
+	}
+	d.checkClaims(now)
 	for k, v := range routeHearts {
 		a := d.alarmCaches[k]
 		a.Id = v.Id
@@ -63,7 +98,7 @@ func (d *device) AddHeart(devId string, routeHearts map[string]models.DeviceAlar
 		a.Alarms = v.Alarms
 		d.alarmCaches[k] = a
 	}
-	newStr, _ := json.Marshal(d.alarmCaches)
+	newStr, _ := json.Marshal(d.withExtraAlarms())
 	if string(oldStr) != string(newStr) {
 		return true
 	}
@@ -82,11 +117,25 @@ func (d *device) GetUpperModules() map[string]string {
 	return modules
 }
 
+// GetUpperId 获取上层路由的设备码
+func (d *device) GetUpperId() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.upperDevice.Id
+}
+
 func (d *device) SetUpperDevice(info models.DeviceKnock) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	d.upperDevice = info
+	// 已启动时，上级变化后更新本级的完整路径
+	if dev, ok := d.localDevices[config.DeviceId()]; ok && info.FullUrl != "" {
+		dev.FullUrl = strings.Trim(info.FullUrl+"/"+dev.Id, "/")
+		dev.Parent = info.Id
+		d.localDevices[dev.Id] = dev
+	}
 }
 
 func (r *device) GetLocalDeviceCache() (models.DeviceKnock, error) {
@@ -97,12 +146,64 @@ func (r *device) GetLocalDeviceCache() (models.DeviceKnock, error) {
 	knock := models.DeviceKnock{
 		Id:      ld.Id,
 		Name:    ld.Name,
+		Desc:    ld.Desc,
 		FullUrl: ld.FullUrl,
+		Tags:    ld.Tags,
 		Modules: ld.Modules,
 	}
 	return knock, nil
 }
 
+// GetFullUrl 获取设备的完整路径，未知设备返回空
+func (d *device) GetFullUrl(devId string) string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.localDevices[devId].FullUrl
+}
+
+// CheckDevice 检查设备是否已知以及是否离线，离线时返回离线时间（未知时为零值）
+// 已敲门、收到过心跳或下级上报过报警的设备都视为已知，路由重启后无需等待重新敲门
+func (d *device) CheckDevice(devId string) (known bool, offline bool, since time.Time) {
+	d.lock.Lock()
+	_, known = d.localDevices[devId]
+	alarm, reported := d.alarmCaches[devId]
+	d.lock.Unlock()
+	known = known || reported || d.monitorBll.Heard(devId)
+
+	// 直接下级根据心跳判断
+	if since, offline = d.monitorBll.GetOfflineTime(devId); offline {
+		return known, true, since
+	}
+	// 更下级的设备根据下级路由上报的报警判断
+	for _, a := range alarm.Alarms {
+		if a.Name == "Network" {
+			return known, true, time.Time{}
+		}
+	}
+	return known, false, time.Time{}
+}
+
+// IsAlive 设备当前是否在线，直接下级根据心跳，更下级根据下级路由上报的报警
+func (d *device) IsAlive(devId string) bool {
+	if devId == config.DeviceId() || d.monitorBll.IsAlive(devId) {
+		return true
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	alarm, ok := d.alarmCaches[devId]
+	if !ok || alarm.Id == "" {
+		return false
+	}
+	for _, a := range alarm.Alarms {
+		if a.Name == "Network" {
+			return false
+		}
+	}
+	return true
+}
+
 func (d *device) GetAllDeviceCache() map[string]models.DeviceKnock {
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -112,7 +213,9 @@ func (d *device) GetAllDeviceCache() map[string]models.DeviceKnock {
 		knocks[k] = models.DeviceKnock{
 			Id:      v.Id,
 			Name:    v.Name,
+			Desc:    v.Desc,
 			FullUrl: v.FullUrl,
+			Tags:    v.Tags,
 			Modules: v.Modules,
 		}
 	}
@@ -130,7 +233,9 @@ func (d *device) SetLocalDevice(infos map[string]models.DeviceKnock) map[string]
 		if door.FullUrl != "" {
 			dev.Id = door.Id
 			dev.Name = door.Name
+			dev.Desc = door.Desc
 			dev.FullUrl = door.FullUrl
+			dev.Tags = door.Tags
 			sp := strings.Split(dev.FullUrl, "/")
 			if len(sp) >= 2 {
 				dev.Parent = sp[len(sp)-2]
@@ -138,25 +243,236 @@ func (d *device) SetLocalDevice(infos map[string]models.DeviceKnock) map[string]
 		}
 		d.localDevices[id] = dev
 	}
+	d.refreshModuleAlarm()
 
 	knocks := map[string]models.DeviceKnock{}
 	for k, v := range d.localDevices {
 		knocks[k] = models.DeviceKnock{
 			Id:      v.Id,
 			Name:    v.Name,
+			Desc:    v.Desc,
 			FullUrl: v.FullUrl,
+			Tags:    v.Tags,
 			Modules: v.Modules,
 		}
 	}
 
 	// 写入到数据库
 	if daos.DeviceDao != nil {
+		for id := range infos {
+			d.saveDevice(d.localDevices[id])
+		}
+	}
+
+	return knocks
+}
+
+// SetLocalTags 更新本机的设备标签
+func (d *device) SetLocalTags(tags map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	dev := d.localDevices[config.DeviceId()]
+	dev.Tags = tags
+	d.localDevices[config.DeviceId()] = dev
+	if daos.DeviceDao != nil {
+		d.saveDevice(dev)
+	}
+}
+
+// SetLocalProfile 更新本机的名称和描述
+func (d *device) SetLocalProfile(name, desc string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	dev := d.localDevices[config.DeviceId()]
+	dev.Name = name
+	dev.Desc = desc
+	d.localDevices[config.DeviceId()] = dev
+	if daos.DeviceDao != nil {
+		d.saveDevice(dev)
+	}
+}
 
+// saveDevice 保存设备登记信息
+func (d *device) saveDevice(dev models.DeviceInfo) {
+	if dev.Id == "" {
+		return
+	}
+	model, _ := daos.DeviceDao.GetCondition("code = ?", dev.Id)
+	if model == nil {
+		model = &daos.Device{Code: dev.Id}
 	}
+	modules, _ := json.Marshal(dev.Modules)
+	tags, _ := json.Marshal(dev.Tags)
+	model.Name = dev.Name
+	model.Desc = dev.Desc
+	model.Parent = dev.Parent
+	model.Modules = string(modules)
+	model.Tags = string(tags)
+	_ = daos.DeviceDao.Save(model)
+}
+
+// RegisteredIds 已登记的所有设备码，包括数据库中的记录
+func (d *device) RegisteredIds() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ids := make([]string, 0)
+	for id := range d.localDevices {
+		ids = append(ids, id)
+	}
+	if daos.DeviceDao != nil {
+		list, _ := daos.DeviceDao.GetAll()
+		for _, m := range list {
+			if _, ok := d.localDevices[m.Code]; !ok && m.Code != "local" {
+				ids = append(ids, m.Code)
+			}
+		}
+	}
+	return ids
+}
 
+// RemoveDevice 从缓存和登记信息中移除设备
+func (d *device) RemoveDevice(devId string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, ok := d.localDevices[devId]
+	delete(d.localDevices, devId)
+	delete(d.alarmCaches, devId)
+	delete(d.driftAlarms, devId)
+	delete(d.dupAlarms, devId)
+	delete(d.claims, devId)
+	if daos.DeviceDao != nil {
+		_ = daos.DeviceDao.DeleteCondition("code = ?", devId)
+	}
+	return ok
+}
+
+// LeaveModules 模块正常退出
+func (d *device) LeaveModules(infos map[string]models.DeviceKnock) map[string]models.DeviceKnock {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for id, door := range infos {
+		dev, ok := d.localDevices[id]
+		if !ok {
+			continue
+		}
+		for _, m := range door.Modules {
+			for i := range dev.Modules {
+				if dev.Modules[i].Name == m.Name {
+					dev.Modules[i].Status = models.EModuleStopped
+					dev.Modules[i].LastSeen = qdefine.NewDateTime(time.Now())
+				}
+			}
+		}
+		d.localDevices[id] = dev
+	}
+	d.refreshModuleAlarm()
+
+	knocks := map[string]models.DeviceKnock{}
+	for k, v := range d.localDevices {
+		knocks[k] = models.DeviceKnock{
+			Id:      v.Id,
+			Name:    v.Name,
+			Desc:    v.Desc,
+			FullUrl: v.FullUrl,
+			Tags:    v.Tags,
+			Modules: v.Modules,
+		}
+	}
 	return knocks
 }
 
+// GetLocalModules 获取本机的模块列表
+func (d *device) GetLocalModules() models.ModuleCollection {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	modules := d.localDevices[config.DeviceId()].Modules
+	list := make(models.ModuleCollection, len(modules))
+	copy(list, modules)
+	return list
+}
+
+// SetModuleStatus 设置本机模块的状态，返回状态是否变化
+func (d *device) SetModuleStatus(name string, status models.EModuleStatus) (models.ModuleInfo, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	dev := d.localDevices[config.DeviceId()]
+	for i := range dev.Modules {
+		if dev.Modules[i].Name != name {
+			continue
+		}
+		changed := dev.Modules[i].Status != status
+		dev.Modules[i].Status = status
+		if status == models.EModuleRunning {
+			dev.Modules[i].LastSeen = qdefine.NewDateTime(time.Now())
+		}
+		d.localDevices[config.DeviceId()] = dev
+		if changed {
+			d.refreshModuleAlarm()
+		}
+		return dev.Modules[i], changed
+	}
+	return models.ModuleInfo{}, false
+}
+
+// refreshModuleAlarm 根据本机模块状态更新失联和版本降级报警
+// 回滚造成的降级不报警，其他降级在稳定运行超过配置的时间后不再报警
+func (d *device) refreshModuleAlarm() {
+	localId := config.DeviceId()
+	dev, ok := d.localDevices[localId]
+	if !ok {
+		return
+	}
+	alarm := d.alarmCaches[localId]
+
+	keep := time.Duration(config.Modules.DowngradeKeep) * time.Hour
+	lost := ""
+	downgrade := ""
+	for i, m := range dev.Modules {
+		if m.Status == models.EModuleStale || m.Status == models.EModuleCrashed {
+			lost += fmt.Sprintf("%s %s\n", m.Name, strings.ToLower(string(m.Status)))
+		}
+		if m.PrevVersion == "" || models.CompareVersion(m.Version, m.PrevVersion) >= 0 {
+			continue
+		}
+		since := m.VerSince.ToTime()
+		if at, ok := d.rollbacks[m.Name]; ok && !since.Before(at.Truncate(time.Second)) {
+			// 回滚后重新敲门的版本是预期的
+			dev.Modules[i].PrevVersion = ""
+			delete(d.rollbacks, m.Name)
+			continue
+		}
+		if keep > 0 && time.Since(since) > keep {
+			continue
+		}
+		downgrade += fmt.Sprintf("%s %s->%s\n", m.Name, m.PrevVersion, m.Version)
+	}
+	d.localDevices[localId] = dev
+	alarm.Set("Module", lost != "", strings.Trim(lost, "\n"), dev)
+	alarm.Set("ModuleDowngrade", downgrade != "", strings.Trim(downgrade, "\n"), dev)
+	d.alarmCaches[localId] = alarm
+}
+
+// ExpectRollback 标记本机模块开始回滚，ok为false表示回滚未执行，取消标记
+func (d *device) ExpectRollback(module string, ok bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !ok {
+		delete(d.rollbacks, module)
+		return
+	}
+	if _, exist := d.rollbacks[module]; !exist {
+		d.rollbacks[module] = time.Now()
+	}
+}
+
 func (d *device) SetAlarm(alarmType string, value string) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -179,7 +495,10 @@ func (d *device) GetAlarmCaches() map[string]models.DeviceAlarm {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	return d.alarmCaches
+	// 降级报警按时间结束，随心跳重新计算
+	d.refreshModuleAlarm()
+
+	return d.withExtraAlarms()
 }
 
 func (d *device) onMonitorChanged(tp string, content any) {
@@ -237,11 +556,15 @@ func (d *device) onHeartChanged(ids map[string]bool) {
 		dev := d.localDevices[k]
 		alarm := d.alarmCaches[k]
 
+		wasOnline := v.IsOnline
 		v.IsOnline = true
 		if _, ok := ids[k]; ok {
 			v.IsOnline = false
 		}
 		alarm.Set("Network", !v.IsOnline, "offline", dev)
+		if !wasOnline && v.IsOnline && d.onOnline != nil {
+			go d.onOnline(k)
+		}
 
 		d.alarmCaches[k] = alarm
 		save[k] = v
@@ -251,13 +574,13 @@ func (d *device) onHeartChanged(ids map[string]bool) {
 	}
 }
 
-func (d *device) GetDeviceAlarm() (any, error) {
+func (d *device) GetDeviceAlarm(filter models.DeviceFilter) (any, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	list := make([]models.DeviceAlarm, 0)
-	for _, v := range d.alarmCaches {
-		if len(v.Alarms) == 0 {
+	for k, v := range d.withExtraAlarms() {
+		if len(v.Alarms) == 0 || !filter.Match(v.FullUrl, d.localDevices[k].Tags) {
 			continue
 		}
 		list = append(list, v)
@@ -268,32 +591,175 @@ func (d *device) GetDeviceAlarm() (any, error) {
 	return list, nil
 }
 
-func (d *device) GetDeviceList() (any, error) {
+func (d *device) GetDeviceList(filter models.DeviceFilter) (any, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	list := make([]map[string]any, 0)
 	for _, v := range d.localDevices {
+		if !filter.Match(v.FullUrl, v.Tags) {
+			continue
+		}
 		list = append(list, map[string]any{
 			"Id":      v.Id,
 			"Name":    v.Name,
+			"Desc":    v.Desc,
 			"Parent":  v.Parent,
 			"FullUrl": v.FullUrl,
+			"Tags":    v.Tags,
 		})
 	}
 	return list, nil
 }
 
-func (d *device) GetDeviceDetail() (any, error) {
+// CheckDrift 按期望版本检查所有设备的模块，返回漂移报警是否变化
+func (d *device) CheckDrift() bool {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	dev := d.localDevices[config.DeviceId()]
-	// 查找详细错误日志
-	for _, m := range dev.Modules {
+	drift := map[string]string{}
+	for id, dev := range d.localDevices {
+		value := ""
+		for _, m := range dev.Modules {
+			expected := config.Inventory.Expected[m.Name]
+			if expected == "" || m.Status == models.EModuleStopped || m.Version == expected {
+				continue
+			}
+			value += fmt.Sprintf("%s %s (expect %s)\n", m.Name, m.Version, expected)
+		}
+		if value != "" {
+			drift[id] = strings.Trim(value, "\n")
+		}
+	}
+	oldStr, _ := json.Marshal(d.driftAlarms)
+	newStr, _ := json.Marshal(drift)
+	d.driftAlarms = drift
+	return string(oldStr) != string(newStr)
+}
+
+// GetInventory 汇总所有设备的模块版本
+func (d *device) GetInventory() []models.ModuleVersion {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	items := map[string]*models.ModuleVersion{}
+	for _, dev := range d.localDevices {
+		for _, m := range dev.Modules {
+			key := m.Name + "^" + m.Version
+			item, ok := items[key]
+			if !ok {
+				item = &models.ModuleVersion{
+					Name:     m.Name,
+					Version:  m.Version,
+					Expected: config.Inventory.Expected[m.Name],
+					Devices:  []string{},
+				}
+				items[key] = item
+			}
+			item.Devices = append(item.Devices, dev.FullUrl)
+		}
+	}
+
+	list := make([]models.ModuleVersion, 0)
+	for _, item := range items {
+		sort.Strings(item.Devices)
+		list = append(list, *item)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return models.CompareVersion(list[i].Version, list[j].Version) > 0
+	})
+	return list
+}
 
-		m.Error = ""
+// withExtraAlarms 将版本漂移和设备码重复报警合并到报警列表，不修改缓存
+func (d *device) withExtraAlarms() map[string]models.DeviceAlarm {
+	alarms := map[string]models.DeviceAlarm{}
+	for k, v := range d.alarmCaches {
+		alarms[k] = v
+	}
+	extra := func(name string, values map[string]string) {
+		for id, value := range values {
+			a := alarms[id]
+			dev := d.localDevices[id]
+			if dev.Id == "" {
+				dev = models.DeviceInfo{Id: a.Id, Name: a.Name, Parent: a.Parent, FullUrl: a.FullUrl}
+			}
+			a.Alarms = append([]models.Item{}, a.Alarms...)
+			a.Set(name, true, value, dev)
+			alarms[id] = a
+		}
+	}
+	extra("VersionDrift", d.driftAlarms)
+	extra("DuplicateDeviceId", d.dupAlarms)
+	return alarms
+}
+
+// addClaim 记录声明使用该设备码的实例或路径
+func (d *device) addClaim(devId, key, desc string, now time.Time) {
+	claims, ok := d.claims[devId]
+	if !ok {
+		claims = map[string]deviceClaim{}
+		d.claims[devId] = claims
+	}
+	c, ok := claims[key]
+	if !ok {
+		c = deviceClaim{desc: desc, first: now}
+	}
+	c.last = now
+	claims[key] = c
+}
+
+// checkClaims 同一设备码的多个实例或路径交替心跳时，视为设备码重复
+// 设备重启或迁移时旧实例在新实例出现后不再心跳，不算重复
+func (d *device) checkClaims(now time.Time) {
+	dup := map[string]string{}
+	for id, claims := range d.claims {
+		for key, c := range claims {
+			if now.Sub(c.last).Seconds() > heartTimeout {
+				delete(claims, key)
+			}
+		}
+		if len(claims) == 0 {
+			delete(d.claims, id)
+			continue
+		}
+		descs := make([]string, 0)
+		for key, c := range claims {
+			for other, o := range claims {
+				// 双方在对方首次出现后都还有心跳
+				if other != key && c.last.After(o.first) && o.last.After(c.first) {
+					descs = append(descs, c.desc)
+					break
+				}
+			}
+		}
+		if len(descs) > 1 {
+			sort.Strings(descs)
+			dup[id] = strings.Join(descs, "\n")
+		}
+	}
+	d.dupAlarms = dup
+}
+
+func (d *device) GetDeviceDetail(uplink models.UplinkState) (any, error) {
+	d.lock.Lock()
+	dev := d.localDevices[config.DeviceId()]
+	// 复制一份避免修改缓存
+	modules := make(models.ModuleCollection, len(dev.Modules))
+	copy(modules, dev.Modules)
+	d.lock.Unlock()
+
+	// 读取日志较慢，在锁外查找详细错误日志
+	for i := range modules {
+		modules[i].Error = d.logsBll.LastError(modules[i].Name)
 	}
-	str, _ := json.Marshal(dev)
+	dev.Modules = modules
+	str, _ := json.Marshal(struct {
+		models.DeviceInfo
+		Uplink models.UplinkState // 当前使用的上级Broker
+	}{dev, uplink})
 	return string(str), nil
 }
@@ -0,0 +1,89 @@
+package blls
+
+import (
+	"github.com/kamioair/qf/qdefine"
+	"router/inner/config"
+	"router/inner/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckClaims(t *testing.T) {
+	type beat struct {
+		key string
+		sec int // 距开始的秒数
+	}
+	tests := []struct {
+		name  string
+		beats []beat
+		check int // 检查时距开始的秒数
+		want  bool
+	}{
+		{"single instance", []beat{{"a", 0}, {"a", 5}, {"a", 10}}, 10, false},
+		{"restart within timeout", []beat{{"a", 0}, {"a", 5}, {"b", 8}, {"b", 13}}, 13, false},
+		{"restart at same time", []beat{{"a", 0}, {"a", 5}, {"b", 5}, {"b", 10}}, 10, false},
+		{"interleaved", []beat{{"a", 0}, {"b", 3}, {"a", 5}, {"b", 8}}, 8, true},
+		{"interleaved once", []beat{{"a", 0}, {"b", 3}, {"a", 5}}, 5, true},
+		{"old claim expired", []beat{{"a", 0}, {"b", 3}, {"a", 5}, {"b", 30}}, 30, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &device{claims: map[string]map[string]deviceClaim{}}
+			start := time.Now()
+			for _, b := range tt.beats {
+				d.addClaim("dev1", b.key, b.key, start.Add(time.Duration(b.sec)*time.Second))
+			}
+			d.checkClaims(start.Add(time.Duration(tt.check) * time.Second))
+			if _, got := d.dupAlarms["dev1"]; got != tt.want {
+				t.Errorf("duplicate = %v, want %v (%v)", got, tt.want, d.dupAlarms)
+			}
+		})
+	}
+}
+
+func TestModuleDowngradeAlarm(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		version  string
+		since    time.Time // 当前版本首次敲门的时间
+		rollback time.Time // 开始回滚的时间，零值为未回滚
+		keep     int
+		want     bool
+	}{
+		{"降级", "1.0", now, time.Time{}, 24, true},
+		{"升级", "3.0", now, time.Time{}, 24, false},
+		{"回滚后的降级", "1.0", now, now.Add(-time.Second), 24, false},
+		{"回滚前已降级", "1.0", now.Add(-time.Hour), now, 24, true},
+		{"稳定运行后不报警", "1.0", now.Add(-25 * time.Hour), time.Time{}, 24, false},
+		{"一直报警", "1.0", now.Add(-25 * time.Hour), time.Time{}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Modules.DowngradeKeep = tt.keep
+			id := config.DeviceId()
+			d := &device{
+				lock: &sync.Mutex{},
+				localDevices: map[string]models.DeviceInfo{id: {Id: id, Modules: models.ModuleCollection{
+					{Name: "Demo", Version: tt.version, PrevVersion: "2.0", VerSince: qdefine.NewDateTime(tt.since)},
+				}}},
+				alarmCaches: map[string]models.DeviceAlarm{},
+				rollbacks:   map[string]time.Time{},
+			}
+			if !tt.rollback.IsZero() {
+				d.rollbacks["Demo"] = tt.rollback
+			}
+			d.refreshModuleAlarm()
+
+			got := false
+			for _, a := range d.alarmCaches[id].Alarms {
+				got = got || a.Name == "ModuleDowngrade"
+			}
+			if got != tt.want {
+				t.Errorf("ModuleDowngrade = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	config.Modules.DowngradeKeep = 24
+}
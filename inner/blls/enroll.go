@@ -0,0 +1,203 @@
+package blls
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kamioair/qf/qdefine"
+	"github.com/kamioair/qf/utils/qio"
+	"router/inner/config"
+	"router/inner/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+type enroll struct {
+	lock  *sync.Mutex
+	items map[string]*models.EnrollRequest // 登记申请，key为申请唯一号
+}
+
+func newEnrollBll() *enroll {
+	e := &enroll{
+		lock:  &sync.Mutex{},
+		items: map[string]*models.EnrollRequest{},
+	}
+	e.load()
+	return e
+}
+
+// Request 设备申请设备码，已审批的返回设备码，否则记录为待审批
+func (e *enroll) Request(req models.EnrollRequest) (string, error) {
+	if req.Fingerprint == "" {
+		return "", errors.New("fingerprint is nil")
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	item := e.find(req.Fingerprint)
+	if item == nil {
+		item = &models.EnrollRequest{
+			Id:          uuid.NewString(),
+			Fingerprint: req.Fingerprint,
+			Status:      "Pending",
+		}
+		e.items[item.Id] = item
+	}
+	switch item.Status {
+	case "Approved":
+		// 指纹由设备自报，审批后还需使用审批时的签名公钥
+		if item.PublicKey != "" && item.PublicKey != req.PublicKey {
+			return "", models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), "enrollment public key mismatch")
+		}
+		return item.DeviceId, nil
+	case "Rejected":
+		return "", models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), "enrollment rejected")
+	}
+	item.PublicKey = req.PublicKey
+	item.Hostname = req.Hostname
+	item.Name = req.Name
+	item.DeviceId = req.DeviceId
+	item.Time = qdefine.NewDateTime(time.Now())
+	e.save()
+	return "", models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), fmt.Sprintf("enrollment %s is pending", item.Id))
+}
+
+// GetList 获取登记申请，按时间倒序
+func (e *enroll) GetList() []models.EnrollRequest {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	list := make([]models.EnrollRequest, 0)
+	for _, item := range e.items {
+		list = append(list, *item)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time > list[j].Time
+	})
+	return list
+}
+
+// Approve 审批通过并分配设备码，设备已在使用临时设备码时沿用
+func (e *enroll) Approve(id string) (models.EnrollRequest, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	item, ok := e.items[id]
+	if !ok {
+		return models.EnrollRequest{}, errors.New(fmt.Sprintf("enrollment %s not find", id))
+	}
+	if item.Status != "Approved" {
+		if item.DeviceId == "" || e.used(item.DeviceId) {
+			item.DeviceId = uuid.NewString()
+		}
+		item.Status = "Approved"
+		e.save()
+	}
+	return *item, nil
+}
+
+// Reject 拒绝登记申请
+func (e *enroll) Reject(id string) (models.EnrollRequest, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	item, ok := e.items[id]
+	if !ok {
+		return models.EnrollRequest{}, errors.New(fmt.Sprintf("enrollment %s not find", id))
+	}
+	item.Status = "Rejected"
+	e.save()
+	return *item, nil
+}
+
+// Seed 将开启审批前已登记的设备视为审批通过，已有申请记录的设备不处理，返回新增的数量
+func (e *enroll) Seed(devIds []string) int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	exist := map[string]bool{}
+	for _, item := range e.items {
+		exist[item.DeviceId] = true
+	}
+	count := 0
+	for _, id := range devIds {
+		if id == "" || exist[id] || id == config.DeviceId() {
+			continue
+		}
+		exist[id] = true
+		item := &models.EnrollRequest{
+			Id:       uuid.NewString(),
+			DeviceId: id,
+			Status:   "Approved",
+			Time:     qdefine.NewDateTime(time.Now()),
+		}
+		e.items[item.Id] = item
+		count++
+	}
+	if count > 0 {
+		e.save()
+	}
+	return count
+}
+
+// IsApproved 设备码是否已审批通过
+func (e *enroll) IsApproved(devId string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, item := range e.items {
+		if item.DeviceId == devId && item.Status == "Approved" {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *enroll) find(fingerprint string) *models.EnrollRequest {
+	for _, item := range e.items {
+		if item.Fingerprint == fingerprint {
+			return item
+		}
+	}
+	return nil
+}
+
+func (e *enroll) used(devId string) bool {
+	if devId == config.DeviceId() {
+		return true
+	}
+	for _, item := range e.items {
+		if item.DeviceId == devId && item.Status == "Approved" {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *enroll) load() {
+	str, err := qio.ReadAllBytes(config.Enroll.File)
+	if err != nil {
+		return
+	}
+	list := make([]*models.EnrollRequest, 0)
+	if json.Unmarshal(str, &list) != nil {
+		return
+	}
+	for _, item := range list {
+		e.items[item.Id] = item
+	}
+}
+
+func (e *enroll) save() {
+	list := make([]*models.EnrollRequest, 0)
+	for _, item := range e.items {
+		list = append(list, item)
+	}
+	js, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return
+	}
+	_ = qio.WriteAllBytes(config.Enroll.File, js, false)
+}
@@ -0,0 +1,125 @@
+package blls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"router/inner/config"
+	"router/inner/models"
+	"strings"
+	"time"
+)
+
+// 超时结束命令后等待输出关闭的时间，子进程启动的后台进程可能一直占用输出管道
+const execWaitDelay = 2 * time.Second
+
+type executor struct {
+	deviceBll *device
+}
+
+func newExecutorBll(deviceBll *device) *executor {
+	return &executor{
+		deviceBll: deviceBll,
+	}
+}
+
+// Run 在本机执行允许列表中的命令
+func (e *executor) Run(req models.ExecRequest) (models.ExecResult, error) {
+	result := models.ExecResult{
+		Device:  e.deviceBll.GetFullUrl(config.DeviceId()),
+		Command: req.Command,
+	}
+	cmdCfg, ok := config.Exec.Commands[req.Command]
+	if !ok || cmdCfg.Path == "" {
+		return result, models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), fmt.Sprintf("command %s is not allowed", req.Command))
+	}
+	if len(req.Args) > 0 && !cmdCfg.AllowArgs {
+		return result, models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), fmt.Sprintf("command %s does not allow args", req.Command))
+	}
+	dir, err := execDir(cmdCfg.Dir, req.Dir)
+	if err != nil {
+		return result, models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), err.Error())
+	}
+
+	// 超时时间不超过配置值
+	timeout := config.Exec.Timeout
+	if req.Timeout > 0 && (timeout <= 0 || req.Timeout < timeout) {
+		timeout = req.Timeout
+	}
+	if timeout <= 0 {
+		timeout = 60
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	args := append(append([]string{}, cmdCfg.Args...), req.Args...)
+	cmd := exec.CommandContext(ctx, cmdCfg.Path, args...)
+	cmd.Dir = dir
+	cmd.WaitDelay = execWaitDelay
+	stdout := &limitBuffer{limit: config.Exec.MaxOutput}
+	stderr := &limitBuffer{limit: config.Exec.MaxOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err = cmd.Run()
+	result.Duration = time.Since(start).Milliseconds()
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	if err != nil {
+		var exitErr *exec.ExitError
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			result.ExitCode = -1
+			result.Error = fmt.Sprintf("command timeout after %ds", timeout)
+		case errors.As(err, &exitErr):
+			result.ExitCode = exitErr.ExitCode()
+		default:
+			result.ExitCode = -1
+			result.Error = err.Error()
+		}
+	}
+	return result, nil
+}
+
+// execDir 计算工作目录，请求的目录需在命令配置的目录之内，未配置目录时限制在沙箱根目录之内
+func execDir(cfgDir, reqDir string) (string, error) {
+	if reqDir == "" {
+		return cfgDir, nil
+	}
+	if cfgDir == "" {
+		cfgDir = config.Files.Root
+	}
+	base, _ := filepath.Abs(cfgDir)
+	dir := reqDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(base, dir)
+	}
+	dir = filepath.Clean(dir)
+	if dir != base && !strings.HasPrefix(dir, base+string(filepath.Separator)) {
+		return "", errors.New(fmt.Sprintf("dir %s is not allowed", reqDir))
+	}
+	return dir, nil
+}
+
+// limitBuffer 超出限制后丢弃的输出缓存
+type limitBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitBuffer) Write(p []byte) (int, error) {
+	if b.limit > 0 && b.Len()+len(p) > b.limit {
+		b.truncated = true
+		if remain := b.limit - b.Len(); remain > 0 {
+			b.Buffer.Write(p[:remain])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
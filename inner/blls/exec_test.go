@@ -0,0 +1,67 @@
+package blls
+
+import (
+	"path/filepath"
+	"router/inner/config"
+	"router/inner/models"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecDir(t *testing.T) {
+	root := t.TempDir()
+	config.Files.Root = filepath.Join(root, "files")
+	cfgDir := filepath.Join(root, "cmd")
+
+	tests := []struct {
+		name   string
+		cfgDir string
+		reqDir string
+		want   string
+		ok     bool
+	}{
+		{"未请求目录使用配置", cfgDir, "", cfgDir, true},
+		{"配置目录内的相对路径", cfgDir, "sub", filepath.Join(cfgDir, "sub"), true},
+		{"跳出配置目录", cfgDir, "../other", "", false},
+		{"配置目录外的绝对路径", cfgDir, "/etc", "", false},
+		{"未配置时限制在沙箱内", "", "sub", filepath.Join(config.Files.Root, "sub"), true},
+		{"未配置时不允许任意目录", "", "/etc", "", false},
+		{"未配置时不允许跳出沙箱", "", "../../", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := execDir(tt.cfgDir, tt.reqDir)
+			if (err == nil) != tt.ok {
+				t.Fatalf("execDir(%q, %q) error = %v, want ok %v", tt.cfgDir, tt.reqDir, err, tt.ok)
+			}
+			if tt.ok && dir != tt.want {
+				t.Errorf("execDir(%q, %q) = %q, want %q", tt.cfgDir, tt.reqDir, dir, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecRunTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("需要sh")
+	}
+	config.Exec.Commands = map[string]config.ExecCommand{
+		// 后台进程继承输出管道，命令本身结束后管道仍未关闭
+		"hold": {Path: "/bin/sh", Args: []string{"-c", "sleep 30 & sleep 30"}},
+	}
+	e := &executor{deviceBll: &device{lock: &sync.Mutex{}, localDevices: map[string]models.DeviceInfo{}}}
+
+	start := time.Now()
+	result, err := e.Run(models.ExecRequest{Command: "hold", Timeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second+execWaitDelay+2*time.Second {
+		t.Errorf("Run() took %v, want about %v", elapsed, time.Second+execWaitDelay)
+	}
+	if result.ExitCode != -1 || result.Error == "" {
+		t.Errorf("Run() = %+v, want timeout", result)
+	}
+}
@@ -0,0 +1,183 @@
+package blls
+
+import (
+	"errors"
+	"github.com/kamioair/qf/qdefine"
+	"github.com/kamioair/qf/utils/qconvert"
+	"github.com/kamioair/qf/utils/qio"
+	"io"
+	"os"
+	"path/filepath"
+	"router/inner/config"
+	"router/inner/models"
+	"strings"
+	"time"
+)
+
+const streamKindFile = "File"
+
+type files struct {
+	deviceBll *device
+	streamBll *stream
+	request   func(info models.RouteInfo) (any, error)
+	onNotice  func(route string, content any)
+}
+
+func newFilesBll(deviceBll *device, streamBll *stream, request func(info models.RouteInfo) (any, error), onNotice func(route string, content any)) *files {
+	return &files{
+		deviceBll: deviceBll,
+		streamBll: streamBll,
+		request:   request,
+		onNotice:  onNotice,
+	}
+}
+
+// Push 将本机沙箱中的文件推送到目标设备
+func (f *files) Push(info models.FileTransfer) (models.StreamState, error) {
+	if info.Device == "" || info.Source == "" || info.Target == "" {
+		return models.StreamState{}, errors.New("file transfer args is nil")
+	}
+	source := sandboxPath(info.Source)
+	sum, err := fileSha256(source)
+	if err != nil {
+		return models.StreamState{}, err
+	}
+	meta := map[string]string{
+		"Kind":   streamKindFile,
+		"Path":   info.Target,
+		"Sha256": sum,
+	}
+	st, err := f.streamBll.Send(info.Device, source, filepath.Base(source), meta)
+	if err != nil {
+		return st, err
+	}
+
+	// 通过通知上报进度
+	go f.progress(st.Id)
+	return st, nil
+}
+
+// Pull 从目标设备拉取文件到本机沙箱，由对方设备推送过来
+func (f *files) Pull(info models.FileTransfer) (models.StreamState, error) {
+	if info.Device == "" || info.Source == "" || info.Target == "" {
+		return models.StreamState{}, errors.New("file transfer args is nil")
+	}
+	rs, err := f.request(models.RouteInfo{
+		Module: info.Device + "/Route",
+		Route:  "PushFile",
+		Content: models.FileTransfer{
+			Device: f.deviceBll.GetFullUrl(config.DeviceId()),
+			Source: info.Source,
+			Target: info.Target,
+		},
+	})
+	if err != nil {
+		return models.StreamState{}, err
+	}
+	st := qconvert.ToAny[models.StreamState](rs)
+
+	// 对方推送到本机，由本机按接收情况上报进度
+	go f.recvProgress(st.Id)
+	return st, nil
+}
+
+// OnReceived 数据流接收完成，写入沙箱
+func (f *files) OnReceived(open models.StreamOpen, part string) error {
+	target := sandboxPath(open.Meta["Path"])
+	if _, err := qio.CreateDirectory(filepath.Dir(target)); err != nil {
+		return err
+	}
+
+	// 先写入同目录的临时文件，校验后再替换，保证原子性
+	tmp := target + ".tmp"
+	if err := copyFile(part, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	sum, err := fileSha256(tmp)
+	if err == nil && sum != open.Meta["Sha256"] {
+		err = errors.New("file sha256 mismatch")
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	f.onNotice("RouteFileReceived", map[string]any{
+		"Source": open.Source,
+		"Path":   open.Meta["Path"],
+		"Size":   open.Size,
+	})
+	return nil
+}
+
+func (f *files) progress(id string) {
+	for {
+		st, ok := f.streamBll.GetState(id)
+		if !ok {
+			return
+		}
+		f.onNotice("RouteFileProgress", st)
+		if st.Status == "Done" || st.Status == "Failed" {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// recvProgress 上报拉取的接收进度，超过续传时间没有进展视为失败
+func (f *files) recvProgress(id string) {
+	timeout := time.Duration(config.Stream.RetryTimeout) * time.Second
+	last := int64(-1)
+	active := time.Now()
+	for {
+		st, ok := f.streamBll.RecvState(id)
+		if ok {
+			f.onNotice("RouteFileProgress", st)
+			if st.Status == "Done" || st.Status == "Failed" {
+				return
+			}
+			if st.Transferred != last {
+				last = st.Transferred
+				active = time.Now()
+			}
+		}
+		if time.Since(active) > timeout {
+			f.onNotice("RouteFileProgress", models.StreamState{Id: id, Status: "Failed", Error: "stream receive timeout", Time: qdefine.NewDateTime(time.Now())})
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// sandboxPath 转为沙箱内的绝对路径，不允许跳出沙箱
+func sandboxPath(rel string) string {
+	root := qio.GetFullPath(config.Files.Root)
+	rel = strings.ReplaceAll(rel, "\\", "/")
+	return filepath.Join(root, filepath.Clean("/"+rel))
+}
+
+func copyFile(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
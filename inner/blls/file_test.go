@@ -0,0 +1,33 @@
+package blls
+
+import (
+	"path/filepath"
+	"router/inner/config"
+	"testing"
+)
+
+func TestSandboxPath(t *testing.T) {
+	root := t.TempDir()
+	config.Files.Root = root
+
+	tests := []struct {
+		name string
+		rel  string
+		want string
+	}{
+		{"文件", "a.txt", filepath.Join(root, "a.txt")},
+		{"子目录", "packages/demo/a.zip", filepath.Join(root, "packages", "demo", "a.zip")},
+		{"绝对路径", "/etc/passwd", filepath.Join(root, "etc", "passwd")},
+		{"跳出目录", "../../etc/passwd", filepath.Join(root, "etc", "passwd")},
+		{"中间跳出目录", "a/../../b.txt", filepath.Join(root, "b.txt")},
+		{"反斜杠跳出目录", `..\..\b.txt`, filepath.Join(root, "b.txt")},
+		{"空路径", "", root},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sandboxPath(tt.rel); got != tt.want {
+				t.Errorf("sandboxPath(%q) = %q, want %q", tt.rel, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package blls
+
+import (
+	"encoding/json"
+	"github.com/kamioair/qf/qdefine"
+	"github.com/kamioair/qf/utils/qio"
+	"router/inner/config"
+	"router/inner/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 最多保留的冲突报告数量
+const identityConflictMax = 100
+
+type identity struct {
+	lock      *sync.Mutex
+	records   map[string]*models.IdentityRecord // 已分配的设备码，key为设备码
+	conflicts []models.IdentityConflict
+}
+
+func newIdentityBll() *identity {
+	i := &identity{
+		lock:      &sync.Mutex{},
+		records:   map[string]*models.IdentityRecord{},
+		conflicts: make([]models.IdentityConflict, 0),
+	}
+	i.load()
+	return i
+}
+
+// Lookup 按硬件信息查找之前分配的设备码，匹配到多个或设备仍在线时记录冲突
+func (i *identity) Lookup(hw models.Hardware, isOnline func(devId string) bool) string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	type match struct {
+		id    string
+		score int
+	}
+	matches := make([]match, 0)
+	for id, rec := range i.records {
+		if score := hardwareScore(hw, rec.Hardware); score > 0 {
+			matches = append(matches, match{id: id, score: score})
+		}
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+	sort.Slice(matches, func(a, b int) bool {
+		if matches[a].score != matches[b].score {
+			return matches[a].score > matches[b].score
+		}
+		return matches[a].id < matches[b].id
+	})
+	ids := make([]string, 0)
+	for _, m := range matches {
+		ids = append(ids, m.id)
+	}
+	if len(matches) > 1 {
+		i.addConflict(hw, ids, "multiple devices matched")
+	}
+	if isOnline(matches[0].id) {
+		// 原设备仍在线，说明是复制的系统或硬件信息重复，分配新的设备码
+		i.addConflict(hw, ids, "matched device is online")
+		return ""
+	}
+	return matches[0].id
+}
+
+// Record 记录分配的设备码对应的硬件信息
+func (i *identity) Record(devId string, hw models.Hardware) {
+	if devId == "" || (hw.MachineId == "" && hw.Serial == "" && len(hw.Macs) == 0) {
+		return
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.records[devId] = &models.IdentityRecord{
+		DeviceId: devId,
+		Hardware: hw,
+		Time:     qdefine.NewDateTime(time.Now()),
+	}
+	i.save()
+}
+
+// Has 是否记录过该设备码的硬件信息
+func (i *identity) Has(devId string) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	_, ok := i.records[devId]
+	return ok
+}
+
+// GetConflicts 获取冲突报告
+func (i *identity) GetConflicts() []models.IdentityConflict {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return append([]models.IdentityConflict{}, i.conflicts...)
+}
+
+func (i *identity) addConflict(hw models.Hardware, ids []string, reason string) {
+	i.conflicts = append(i.conflicts, models.IdentityConflict{
+		Time:      qdefine.NewDateTime(time.Now()),
+		Hardware:  hw,
+		DeviceIds: ids,
+		Reason:    reason,
+	})
+	if len(i.conflicts) > identityConflictMax {
+		i.conflicts = i.conflicts[len(i.conflicts)-identityConflictMax:]
+	}
+}
+
+func (i *identity) load() {
+	str, err := qio.ReadAllBytes(config.Identity.File)
+	if err != nil {
+		return
+	}
+	list := make([]*models.IdentityRecord, 0)
+	if json.Unmarshal(str, &list) != nil {
+		return
+	}
+	for _, rec := range list {
+		i.records[rec.DeviceId] = rec
+	}
+}
+
+func (i *identity) save() {
+	list := make([]*models.IdentityRecord, 0)
+	for _, rec := range i.records {
+		list = append(list, rec)
+	}
+	js, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return
+	}
+	_ = qio.WriteAllBytes(config.Identity.File, js, false)
+}
+
+// hardwareScore 硬件信息匹配程度，机器码或主板序列号相同且至少一个物理网卡地址相同才算匹配，否则返回0
+// 网卡地址和厂商占位的序列号可能在多台设备上重复，单独相同不能说明是同一台设备
+func hardwareScore(a, b models.Hardware) int {
+	score := 0
+	if a.MachineId != "" && a.MachineId == b.MachineId {
+		score += 2
+	}
+	if models.ValidSerial(a.Serial) && a.Serial == b.Serial {
+		score += 2
+	}
+	if score == 0 {
+		return 0
+	}
+	macs := 0
+	for _, m := range a.Macs {
+		if !models.PhysicalMac(m) {
+			continue
+		}
+		for _, n := range b.Macs {
+			if strings.EqualFold(m, n) {
+				macs++
+				break
+			}
+		}
+	}
+	if macs == 0 {
+		return 0
+	}
+	return score + macs
+}
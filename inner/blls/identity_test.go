@@ -0,0 +1,48 @@
+package blls
+
+import (
+	"router/inner/models"
+	"testing"
+)
+
+func TestHardwareScore(t *testing.T) {
+	const (
+		mac1   = "00:1a:2b:3c:4d:5e"
+		mac2   = "00:1a:2b:3c:4d:5f"
+		docker = "02:42:ac:11:00:02"
+	)
+	rec := models.Hardware{MachineId: "m1", Serial: "SN001", Macs: []string{mac1, mac2, docker}}
+	tests := []struct {
+		name string
+		hw   models.Hardware
+		want int
+	}{
+		{"all matched", models.Hardware{MachineId: "m1", Serial: "SN001", Macs: []string{mac1, mac2}}, 6},
+		{"machine id and mac", models.Hardware{MachineId: "m1", Macs: []string{mac1}}, 3},
+		{"serial and mac", models.Hardware{Serial: "SN001", Macs: []string{"00:1A:2B:3C:4D:5E"}}, 3},
+		{"machine id only", models.Hardware{MachineId: "m1"}, 0},
+		{"serial only", models.Hardware{Serial: "SN001"}, 0},
+		{"single shared mac", models.Hardware{MachineId: "m2", Macs: []string{mac1}}, 0},
+		{"virtual mac only", models.Hardware{MachineId: "m1", Macs: []string{docker}}, 0},
+		{"nothing", models.Hardware{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hardwareScore(tt.hw, rec); got != tt.want {
+				t.Errorf("hardwareScore() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHardwareScorePlaceholderSerial(t *testing.T) {
+	const mac = "00:1a:2b:3c:4d:5e"
+	for _, serial := range []string{"To be filled by O.E.M.", "Default string", "0", "000000", "System Serial Number", " None "} {
+		t.Run(serial, func(t *testing.T) {
+			a := models.Hardware{Serial: serial, Macs: []string{mac}}
+			if got := hardwareScore(a, a); got != 0 {
+				t.Errorf("hardwareScore() = %d, want 0", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package blls
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kamioair/qf/qdefine"
+	"github.com/kamioair/qf/utils/qio"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"router/inner/config"
+	"router/inner/models"
+	"sort"
+	"strings"
+)
+
+// 读取日志尾部的最大字节数
+const logTailBytes = 4 * 1024 * 1024
+
+type logs struct {
+}
+
+func newLogsBll() *logs {
+	return &logs{}
+}
+
+// List 列出模块的日志文件，按修改时间倒序
+func (l *logs) List(module string) ([]models.LogFile, error) {
+	if err := checkLogModule(module); err != nil {
+		return nil, err
+	}
+	list := make([]models.LogFile, 0)
+	for _, dir := range logDirs(module) {
+		_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || strings.HasSuffix(d.Name(), ".log") == false {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(dir, path)
+			list = append(list, models.LogFile{
+				Module: module,
+				Name:   filepath.ToSlash(rel),
+				Size:   info.Size(),
+				Time:   qdefine.NewDateTime(info.ModTime()),
+			})
+			return nil
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Time > list[j].Time
+	})
+	return list, nil
+}
+
+// Tail 读取日志文件的最后几行
+func (l *logs) Tail(query models.LogQuery) ([]string, error) {
+	file, err := l.find(query.Module, query.File, false)
+	if err != nil {
+		return nil, err
+	}
+	lines := query.Lines
+	if lines <= 0 || lines > config.Logs.MaxLines {
+		lines = config.Logs.MaxLines
+	}
+	content, err := readTail(file)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := strings.ToLower(query.Filter)
+	list := make([]string, 0)
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if filter != "" && strings.Contains(strings.ToLower(line), filter) == false {
+			continue
+		}
+		list = append(list, line)
+	}
+	if len(list) > lines {
+		list = list[len(list)-lines:]
+	}
+	return list, nil
+}
+
+// LastError 获取模块最新的一条错误日志
+func (l *logs) LastError(module string) string {
+	file, err := l.find(module, "", true)
+	if err != nil {
+		return ""
+	}
+	content, err := readTail(file)
+	if err != nil {
+		return ""
+	}
+	// 错误日志之间以分隔线隔开
+	entries := strings.Split(content, "------------------------------")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.Trim(entries[i], "-\r\n ")
+		if entry == "" {
+			continue
+		}
+		if len(entry) > 2048 {
+			entry = entry[:2048]
+		}
+		return entry
+	}
+	return ""
+}
+
+// find 查找日志文件，未指定文件名时使用最新的
+func (l *logs) find(module, name string, onlyError bool) (string, error) {
+	if err := checkLogModule(module); err != nil {
+		return "", err
+	}
+	if name != "" {
+		if strings.HasSuffix(name, ".log") == false {
+			return "", errors.New(fmt.Sprintf("log file %s is not allowed", name))
+		}
+		for _, dir := range logDirs(module) {
+			// 限制在日志目录之内，且只读取普通文件
+			file := filepath.Join(dir, filepath.Clean("/"+strings.ReplaceAll(name, "\\", "/")))
+			if info, err := os.Lstat(file); err == nil && info.Mode().IsRegular() {
+				return file, nil
+			}
+		}
+		return "", errors.New(fmt.Sprintf("log file %s not find", name))
+	}
+	list, _ := l.List(module)
+	for _, f := range list {
+		if onlyError && strings.HasSuffix(f.Name, "_Error.log") == false {
+			continue
+		}
+		return l.find(module, f.Name, false)
+	}
+	return "", errors.New(fmt.Sprintf("module %s has no log", module))
+}
+
+// checkLogModule 检查模块名称，不允许包含路径
+func checkLogModule(module string) error {
+	if module == "" {
+		return errors.New("module is nil")
+	}
+	if strings.ContainsAny(module, "/\\") || strings.Contains(module, "..") {
+		return errors.New(fmt.Sprintf("module %s is not allowed", module))
+	}
+	return nil
+}
+
+// logDirs 模块的日志目录
+func logDirs(module string) []string {
+	dirs := make([]string, 0)
+	if module == "Route" {
+		dirs = append(dirs, qio.GetFullPath("./log"))
+	}
+	for _, p := range config.Logs.Paths {
+		dir := qio.GetFullPath(strings.ReplaceAll(p, "{module}", module))
+		if qio.PathExists(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func readTail(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := stat.Size() - logTailBytes
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	content := string(buf)
+	if offset > 0 {
+		// 去掉不完整的第一行
+		if i := strings.Index(content, "\n"); i >= 0 {
+			content = content[i+1:]
+		}
+	}
+	return content, nil
+}
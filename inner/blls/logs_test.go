@@ -0,0 +1,56 @@
+package blls
+
+import (
+	"os"
+	"path/filepath"
+	"router/inner/config"
+	"testing"
+)
+
+func TestLogsFind(t *testing.T) {
+	root := t.TempDir()
+	config.Logs.Paths = []string{filepath.Join(root, "{module}", "log")}
+	dir := filepath.Join(root, "Demo", "log")
+	_ = os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "app.log"), []byte("ok"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "sub", "app_Error.log"), []byte("err"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("no"), 0644)
+	_ = os.MkdirAll(filepath.Join(root, "var", "log"), 0755)
+	_ = os.WriteFile(filepath.Join(root, "var", "log", "auth.log"), []byte("no"), 0644)
+
+	l := newLogsBll()
+	tests := []struct {
+		name   string
+		module string
+		file   string
+		want   string
+	}{
+		{"日志文件", "Demo", "app.log", filepath.Join(dir, "app.log")},
+		{"子目录", "Demo", "sub/app_Error.log", filepath.Join(dir, "sub", "app_Error.log")},
+		{"非日志文件", "Demo", "secret.txt", ""},
+		{"文件名跳出目录", "Demo", "../../var/log/auth.log", ""},
+		{"模块名跳出目录", "../var", "auth.log", ""},
+		{"模块名包含分隔符", "Demo/../var", "auth.log", ""},
+		{"模块名包含反斜杠", `..\var`, "auth.log", ""},
+		{"空模块", "", "app.log", ""},
+		{"文件不存在", "Demo", "none.log", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := l.find(tt.module, tt.file, false)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("find(%q, %q) = %q, want error", tt.module, tt.file, file)
+				}
+				return
+			}
+			if err != nil || file != tt.want {
+				t.Fatalf("find(%q, %q) = %q, %v, want %q", tt.module, tt.file, file, err, tt.want)
+			}
+		})
+	}
+
+	if file, err := l.find("Demo", "", true); err != nil || file != filepath.Join(dir, "sub", "app_Error.log") {
+		t.Errorf("find error log = %q, %v", file, err)
+	}
+}
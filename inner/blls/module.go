@@ -0,0 +1,56 @@
+package blls
+
+import (
+	"router/inner/config"
+	"router/inner/models"
+	"time"
+)
+
+type lifecycle struct {
+	deviceBll *device
+	probe     func(name string) bool       // 探测本机模块是否有响应
+	onChanged func(info models.ModuleInfo) // 模块状态变化
+}
+
+func newLifecycleBll(deviceBll *device, probe func(name string) bool, onChanged func(info models.ModuleInfo)) *lifecycle {
+	return &lifecycle{
+		deviceBll: deviceBll,
+		probe:     probe,
+		onChanged: onChanged,
+	}
+}
+
+func (l *lifecycle) Start() {
+	if config.Modules.StaleTimeout <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			l.check()
+		}
+	}()
+}
+
+// check 检查本机模块，超时未敲门的先探测，无响应则标记为失联或崩溃
+func (l *lifecycle) check() {
+	for _, m := range l.deviceBll.GetLocalModules() {
+		if m.Status == models.EModuleStopped || m.Name == "Route" {
+			continue
+		}
+		since := time.Since(m.LastSeen.ToTime()).Seconds()
+		if since <= float64(config.Modules.StaleTimeout) {
+			continue
+		}
+		status := models.EModuleStale
+		if l.probe(m.Name) {
+			status = models.EModuleRunning
+		} else if config.Modules.CrashTimeout > 0 && since > float64(config.Modules.CrashTimeout) {
+			status = models.EModuleCrashed
+		}
+		if info, changed := l.deviceBll.SetModuleStatus(m.Name, status); changed {
+			l.onChanged(info)
+		}
+	}
+}
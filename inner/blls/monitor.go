@@ -16,6 +16,9 @@ import (
 	"time"
 )
 
+// 超过该时间（秒）未收到心跳视为离线
+const heartTimeout = 20
+
 type monitor struct {
 	mode             qservice.EServerMode
 	crn              *cron.Cron
@@ -72,6 +75,36 @@ func (m *monitor) AddHeart(devId string) {
 	m.heartAlarms[devId] = time.Now().Local()
 }
 
+// GetOfflineTime 获取设备的离线时间（即最后一次心跳时间），在线或从未心跳返回false
+func (m *monitor) GetOfflineTime(devId string) (time.Time, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	last, ok := m.heartAlarms[devId]
+	if !ok || time.Now().Local().Sub(last).Seconds() <= heartTimeout {
+		return time.Time{}, false
+	}
+	return last, true
+}
+
+// Heard 是否收到过设备的心跳
+func (m *monitor) Heard(devId string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, ok := m.heartAlarms[devId]
+	return ok
+}
+
+// IsAlive 设备是否在超时时间内发送过心跳
+func (m *monitor) IsAlive(devId string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	last, ok := m.heartAlarms[devId]
+	return ok && time.Now().Local().Sub(last).Seconds() <= heartTimeout
+}
+
 func (m *monitor) checkCpu() {
 	percentages, err := cpu.Percent(time.Second, true)
 	if err != nil || len(percentages) == 0 {
@@ -256,7 +289,7 @@ func (m *monitor) checkHeart() {
 	offlineList := map[string]bool{}
 	for k, v := range m.heartAlarms {
 		second := time.Now().Local().Sub(v).Seconds()
-		if second > 20 {
+		if second > heartTimeout {
 			offlineList[k] = true
 		}
 	}
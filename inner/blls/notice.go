@@ -0,0 +1,343 @@
+package blls
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	easyCon "github.com/qiu-tec/easy-con.golang"
+	"path"
+	"router/inner/config"
+	"router/inner/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type notice struct {
+	lock          *sync.Mutex
+	deviceBll     *device
+	localAdapter  easyCon.IAdapter        // 自己Broker访问器
+	upperAdapter  func() easyCon.IAdapter // 上层Broker访问器
+	postUpper     func(module, route string, content any)
+	listenAdapter easyCon.IAdapter     // 监听本地Broker通知的访问器
+	locals        map[string][]string  // 本地模块的订阅，key为模块名称
+	children      map[string][]string  // 下级路由的汇总订阅，key为下级路由设备码
+	upper         []string             // 上级路由需要的订阅
+	pushed        map[string]string    // 最后一次推送给下级路由的订阅，用于判断是否变化
+	recent        map[string]time.Time // 最近转发过的通知，用于去重
+}
+
+func newNoticeBll(localAdapter easyCon.IAdapter, upperAdapter func() easyCon.IAdapter, deviceBll *device, postUpper func(module, route string, content any)) *notice {
+	return &notice{
+		lock:         &sync.Mutex{},
+		deviceBll:    deviceBll,
+		localAdapter: localAdapter,
+		upperAdapter: upperAdapter,
+		postUpper:    postUpper,
+		locals:       map[string][]string{},
+		children:     map[string][]string{},
+		upper:        []string{},
+		pushed:       map[string]string{},
+		recent:       map[string]time.Time{},
+	}
+}
+
+// Start 启动
+func (n *notice) Start() {
+	// 客户端和服务端共用同一个Broker，由服务端路由统一监听和转发
+	if config.Mode.IsClient() {
+		return
+	}
+	setting := easyCon.NewSetting(fmt.Sprintf("Route.%s.[NOTICE]", config.DeviceId()), config.LocalMqtt.Addr, n.onReq, n.onStatus)
+	setting.UID = config.LocalMqtt.UId
+	setting.PWD = config.LocalMqtt.Pwd
+	setting.TimeOut = time.Duration(config.LocalMqtt.TimeOut) * time.Second
+	setting.ReTry = config.LocalMqtt.Retry
+	setting.LogMode = easyCon.ELogMode(config.LocalMqtt.LogMode)
+	setting.OnNotice = n.onLocalNotice
+	n.listenAdapter = easyCon.NewMqttAdapter(setting)
+
+	// 向上级路由登记
+	n.pushUpper()
+}
+
+// Subscribe 登记订阅，模块或者下级路由调用
+func (n *notice) Subscribe(info models.NoticeInterest) ([]string, error) {
+	if info.Id == "" {
+		return nil, errors.New("notice subscriber is nil")
+	}
+
+	// 客户端路由直接转给服务端路由，以本设备码区分模块
+	if config.Mode.IsClient() {
+		info.Id = fmt.Sprintf("%s.%s", info.Id, config.DeviceId())
+		resp := n.localAdapter.Req("Route", "SubscribeNotice", info)
+		if resp.RespCode != easyCon.ERespSuccess {
+			return nil, errors.New(fmt.Sprintf("subscribe notice failed: %d", resp.RespCode))
+		}
+		return []string{}, nil
+	}
+
+	n.lock.Lock()
+	if info.Router {
+		if len(info.Patterns) == 0 {
+			delete(n.children, info.Id)
+		} else {
+			n.children[info.Id] = info.Patterns
+		}
+	} else {
+		if len(info.Patterns) == 0 {
+			delete(n.locals, info.Id)
+		} else {
+			n.locals[info.Id] = info.Patterns
+		}
+	}
+	var back []string
+	if info.Router {
+		// 记录已推送给该下级的内容
+		back = n.wantsOfChild(info.Id)
+		n.pushed[info.Id] = strings.Join(back, "\n")
+	}
+	n.lock.Unlock()
+
+	// 订阅变化后通知其他方向
+	go n.pushUpper()
+	go n.pushChildren()
+
+	if back == nil {
+		back = []string{}
+	}
+	return back, nil
+}
+
+// SetUpper 上级路由推送的订阅
+func (n *notice) SetUpper(patterns []string) {
+	n.lock.Lock()
+	n.upper = patterns
+	n.lock.Unlock()
+
+	go n.pushChildren()
+}
+
+// Forward 处理其他路由转发过来的通知
+func (n *notice) Forward(fw models.NoticeForward, fromUpper bool) {
+	if n.isRepeat(fw.Id) {
+		return
+	}
+	from := fw.From
+	if fromUpper {
+		from = ""
+	}
+
+	n.lock.Lock()
+	target := fw.Source + "/" + fw.Route
+	toLocal := matchAny(unionPatterns(n.locals, ""), target)
+	toUpper := !fromUpper && matchAny(n.upper, target)
+	children := n.matchChildren(target, from)
+	n.lock.Unlock()
+
+	// 发布到本地Broker，路由名带上来源，避免被当作本路由自身的通知
+	if toLocal {
+		_ = n.localAdapter.SendNotice(target, fw.Content)
+	}
+	n.send(fw, toUpper, children)
+}
+
+func (n *notice) onLocalNotice(pack easyCon.PackNotice) {
+	// 路由自身的通知（包含转发过来的）不再处理
+	if pack.From == "Route" || strings.HasPrefix(pack.From, "Route.") {
+		return
+	}
+
+	// 计算通知来源
+	module := pack.From
+	devId := config.DeviceId()
+	if i := strings.LastIndex(pack.From, "."); i > 0 {
+		module = pack.From[:i]
+		devId = pack.From[i+1:]
+	}
+	fullUrl := n.deviceBll.GetFullUrl(devId)
+	if fullUrl == "" {
+		fullUrl = n.deviceBll.GetFullUrl(config.DeviceId())
+	}
+	fw := models.NoticeForward{
+		Id:      uuid.NewString(),
+		Source:  fullUrl + "/" + module,
+		Route:   pack.Route,
+		Content: pack.Content,
+	}
+	n.isRepeat(fw.Id)
+
+	n.lock.Lock()
+	target := fw.Source + "/" + fw.Route
+	toUpper := matchAny(n.upper, target)
+	children := n.matchChildren(target, "")
+	n.lock.Unlock()
+
+	n.send(fw, toUpper, children)
+}
+
+func (n *notice) send(fw models.NoticeForward, toUpper bool, children []string) {
+	fw.From = config.DeviceId()
+	if toUpper {
+		// 上行通知，断线时写入离线缓存
+		go n.postUpper("Route", "ForwardNotice", fw)
+	}
+	for _, c := range children {
+		go n.localAdapter.Req(fmt.Sprintf("Route.%s", c), "ForwardNotice", fw)
+	}
+}
+
+// pushUpper 将本级及下级的汇总订阅推送给上级路由
+func (n *notice) pushUpper() {
+	upper := n.upperAdapter()
+	if upper == nil {
+		return
+	}
+	n.lock.Lock()
+	info := models.NoticeInterest{
+		Id:       config.DeviceId(),
+		Router:   true,
+		Patterns: n.wantsOfUpper(),
+	}
+	n.lock.Unlock()
+
+	resp := upper.Req("Route", "SubscribeNotice", info)
+	if resp.RespCode == easyCon.ERespSuccess {
+		patterns := make([]string, 0)
+		if list, ok := resp.Content.([]any); ok {
+			for _, p := range list {
+				patterns = append(patterns, fmt.Sprintf("%v", p))
+			}
+		}
+		n.SetUpper(patterns)
+	}
+}
+
+// pushChildren 将变化后的订阅推送给各个下级路由
+func (n *notice) pushChildren() {
+	n.lock.Lock()
+	changes := map[string][]string{}
+	for c := range n.children {
+		wants := n.wantsOfChild(c)
+		str := strings.Join(wants, "\n")
+		if n.pushed[c] != str {
+			n.pushed[c] = str
+			changes[c] = wants
+		}
+	}
+	n.lock.Unlock()
+
+	for c, wants := range changes {
+		n.localAdapter.Req(fmt.Sprintf("Route.%s", c), "SetNoticeInterest", wants)
+	}
+}
+
+// wantsOfUpper 上级路由需要从本级获得的订阅
+func (n *notice) wantsOfUpper() []string {
+	list := unionPatterns(n.locals, "")
+	list = append(list, unionPatterns(n.children, "")...)
+	return distinctPatterns(list)
+}
+
+// wantsOfChild 下级路由需要从本级获得的订阅
+func (n *notice) wantsOfChild(child string) []string {
+	list := unionPatterns(n.locals, "")
+	list = append(list, unionPatterns(n.children, child)...)
+	list = append(list, n.upper...)
+	return distinctPatterns(list)
+}
+
+func (n *notice) matchChildren(target string, except string) []string {
+	children := make([]string, 0)
+	for c, patterns := range n.children {
+		if c == except {
+			continue
+		}
+		if matchAny(patterns, target) {
+			children = append(children, c)
+		}
+	}
+	return children
+}
+
+func (n *notice) isRepeat(id string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	now := time.Now()
+	for k, v := range n.recent {
+		if now.Sub(v) > time.Minute {
+			delete(n.recent, k)
+		}
+	}
+	if _, ok := n.recent[id]; ok {
+		return true
+	}
+	n.recent[id] = now
+	return false
+}
+
+func (n *notice) onReq(pack easyCon.PackReq) (easyCon.EResp, any) {
+	return easyCon.ERespRouteNotFind, nil
+}
+
+func (n *notice) onStatus(adapter easyCon.IAdapter, status easyCon.EStatus) {
+
+}
+
+func unionPatterns(subs map[string][]string, except string) []string {
+	list := make([]string, 0)
+	for k, v := range subs {
+		if k == except {
+			continue
+		}
+		list = append(list, v...)
+	}
+	return list
+}
+
+func distinctPatterns(list []string) []string {
+	exist := map[string]bool{}
+	rs := make([]string, 0)
+	for _, p := range list {
+		if exist[p] {
+			continue
+		}
+		exist[p] = true
+		rs = append(rs, p)
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+func matchAny(patterns []string, target string) bool {
+	for _, p := range patterns {
+		if matchPattern(strings.Split(p, "/"), strings.Split(target, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern 按层级匹配，*匹配一级（支持层级内通配），**匹配任意级
+func matchPattern(pattern []string, target []string) bool {
+	if len(pattern) == 0 {
+		return len(target) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(target); i++ {
+			if matchPattern(pattern[1:], target[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(target) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], target[0]); !ok {
+		return false
+	}
+	return matchPattern(pattern[1:], target[1:])
+}
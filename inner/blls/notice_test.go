@@ -0,0 +1,33 @@
+package blls
+
+import (
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		target  string
+		want    bool
+	}{
+		{"root/dev1/Demo/Changed", "root/dev1/Demo/Changed", true},
+		{"root/dev1/Demo/Changed", "root/dev1/Demo/Other", false},
+		{"root/*/Demo/Changed", "root/dev1/Demo/Changed", true},
+		{"root/*/Demo/Changed", "root/a/dev1/Demo/Changed", false},
+		{"root/**/Demo/Changed", "root/a/dev1/Demo/Changed", true},
+		{"root/**/Demo/Changed", "root/Demo/Changed", true},
+		{"root/**", "root/dev1/Demo/Changed", true},
+		{"**", "root/dev1/Demo/Changed", true},
+		{"root/dev*/Demo/*", "root/dev1/Demo/Changed", true},
+		{"root/dev*/Demo/*", "root/box1/Demo/Changed", false},
+		{"root/dev1/Demo", "root/dev1/Demo/Changed", false},
+		{"root/dev1/Demo/Changed/More", "root/dev1/Demo/Changed", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"|"+tt.target, func(t *testing.T) {
+			if got := matchAny([]string{tt.pattern}, tt.target); got != tt.want {
+				t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.target, got, tt.want)
+			}
+		})
+	}
+}
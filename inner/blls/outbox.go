@@ -0,0 +1,258 @@
+package blls
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kamioair/qf/qdefine"
+	"github.com/kamioair/qf/utils/qio"
+	easyCon "github.com/qiu-tec/easy-con.golang"
+	"os"
+	"router/inner/config"
+	"router/inner/models"
+	"sync"
+	"time"
+)
+
+// outboxLine 缓存日志的一行，Drop不为0时表示Id不大于Drop的缓存均已移除
+type outboxLine struct {
+	models.QueueItem
+	Drop uint64 `json:",omitempty"`
+}
+
+type outbox struct {
+	lock      *sync.Mutex
+	items     []models.QueueItem
+	seq       uint64
+	dropped   int
+	flushing  bool
+	lastFlush time.Time
+	lines     int // 缓存日志的行数，超出较多时压缩
+	send      func(module, route string, content any) easyCon.PackResp
+}
+
+func newOutboxBll(send func(module, route string, content any) easyCon.PackResp) *outbox {
+	o := &outbox{
+		lock:  &sync.Mutex{},
+		items: make([]models.QueueItem, 0),
+		send:  send,
+	}
+	o.load()
+	return o
+}
+
+// Count 当前缓存条数
+func (o *outbox) Count() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return len(o.items)
+}
+
+// Add 写入缓存
+func (o *outbox) Add(module, route string, content any) {
+	js, err := json.Marshal(content)
+	if err != nil {
+		return
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.seq++
+	item := models.QueueItem{
+		Id:      o.seq,
+		Time:    qdefine.NewDateTime(time.Now()),
+		Module:  module,
+		Route:   route,
+		Content: js,
+	}
+	o.items = append(o.items, item)
+	o.append(item)
+	o.drop(o.limit())
+}
+
+// Flush 按顺序重发缓存，遇到连接故障则停止等待下次重发
+func (o *outbox) Flush() {
+	o.lock.Lock()
+	if o.flushing {
+		o.lock.Unlock()
+		return
+	}
+	o.flushing = true
+	o.drop(o.limit())
+	o.lock.Unlock()
+
+	defer func() {
+		o.lock.Lock()
+		o.flushing = false
+		o.lastFlush = time.Now()
+		o.lock.Unlock()
+	}()
+
+	for {
+		o.lock.Lock()
+		if len(o.items) == 0 {
+			o.lock.Unlock()
+			return
+		}
+		item := o.items[0]
+		o.lock.Unlock()
+
+		resp := o.send(item.Module, item.Route, item.Content)
+		if isLinkFault(resp.RespCode) {
+			return
+		}
+
+		// 发送成功或者对方已处理（即使返回错误）都移除
+		o.lock.Lock()
+		if len(o.items) > 0 && o.items[0].Id == item.Id {
+			o.items = o.items[1:]
+			o.drop(item.Id)
+		}
+		o.lock.Unlock()
+	}
+}
+
+// GetState 获取缓存状态
+func (o *outbox) GetState() models.QueueState {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	state := models.QueueState{
+		Count:    len(o.items),
+		Dropped:  o.dropped,
+		Flushing: o.flushing,
+	}
+	for _, item := range o.items {
+		state.Size += len(item.Content)
+	}
+	if len(o.items) > 0 {
+		state.Oldest = o.items[0].Time
+	}
+	if o.lastFlush.IsZero() == false {
+		state.LastFlush = qdefine.NewDateTime(o.lastFlush)
+	}
+	return state
+}
+
+// limit 丢弃超出条数和超时的缓存，返回最后丢弃的Id，未丢弃时返回0
+func (o *outbox) limit() uint64 {
+	count := 0
+	if config.Queue.MaxAge > 0 {
+		expire := time.Now().Add(-time.Duration(config.Queue.MaxAge) * time.Second)
+		for count < len(o.items) && o.items[count].Time.ToTime().Before(expire) {
+			count++
+		}
+	}
+	if config.Queue.MaxCount > 0 && len(o.items)-count > config.Queue.MaxCount {
+		count = len(o.items) - config.Queue.MaxCount
+	}
+	if count == 0 {
+		return 0
+	}
+	last := o.items[count-1].Id
+	o.dropped += count
+	o.items = o.items[count:]
+	return last
+}
+
+// drop 记录Id不大于指定值的缓存已移除，日志中无效行过多时压缩
+func (o *outbox) drop(id uint64) {
+	if id == 0 {
+		return
+	}
+	if o.lines > len(o.items)*2+1000 {
+		o.compact()
+		return
+	}
+	o.append(struct{ Drop uint64 }{Drop: id})
+}
+
+// append 向缓存日志追加一行
+func (o *outbox) append(line any) {
+	js, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	if qio.WriteAllBytes(config.Queue.File, append(js, '\n'), true) == nil {
+		o.lines++
+	}
+}
+
+// compact 只保留当前缓存重写日志，先写临时文件再替换
+func (o *outbox) compact() {
+	buf := &bytes.Buffer{}
+	for _, item := range o.items {
+		js, err := json.Marshal(item)
+		if err != nil {
+			continue
+		}
+		buf.Write(js)
+		buf.WriteByte('\n')
+	}
+	tmp := fmt.Sprintf("%s.tmp", config.Queue.File)
+	if qio.WriteAllBytes(tmp, buf.Bytes(), false) != nil {
+		return
+	}
+	if os.Rename(tmp, config.Queue.File) != nil {
+		return
+	}
+	o.lines = len(o.items)
+}
+
+func (o *outbox) load() {
+	str, err := qio.ReadAllBytes(config.Queue.File)
+	if err != nil {
+		return
+	}
+
+	// 兼容旧版整体写入的Json数组
+	if bytes.HasPrefix(bytes.TrimSpace(str), []byte("[")) {
+		items := make([]models.QueueItem, 0)
+		if json.Unmarshal(str, &items) != nil {
+			return
+		}
+		o.items = items
+		if len(items) > 0 {
+			o.seq = items[len(items)-1].Id
+		}
+		o.compact()
+		return
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(str))
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		o.lines++
+		line := outboxLine{}
+		// 异常退出时最后一行可能不完整，跳过
+		if json.Unmarshal(scanner.Bytes(), &line) != nil {
+			continue
+		}
+		if line.Drop > 0 {
+			index := 0
+			for index < len(o.items) && o.items[index].Id <= line.Drop {
+				index++
+			}
+			o.items = o.items[index:]
+			if line.Drop > o.seq {
+				o.seq = line.Drop
+			}
+			continue
+		}
+		if line.Id > o.seq {
+			o.seq = line.Id
+			o.items = append(o.items, line.QueueItem)
+		}
+	}
+	if o.lines > len(o.items)*2+1000 {
+		o.compact()
+	}
+}
+
+// isLinkFault 是否为连接故障（未连接或超时）
+func isLinkFault(code easyCon.EResp) bool {
+	return code == easyCon.ERespUnLinked || code == easyCon.ERespTimeout
+}
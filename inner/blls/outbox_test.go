@@ -0,0 +1,124 @@
+package blls
+
+import (
+	"encoding/json"
+	easyCon "github.com/qiu-tec/easy-con.golang"
+	"os"
+	"path/filepath"
+	"router/inner/config"
+	"router/inner/models"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOutboxJournal(t *testing.T) {
+	tests := []struct {
+		name    string
+		adds    int
+		codes   []easyCon.EResp // 依次发送的结果，之后都成功
+		max     int             // 最多缓存条数
+		wantIds []int           // 剩余的缓存
+	}{
+		{"全部发送", 3, nil, 0, []int{}},
+		{"发送中断", 3, []easyCon.EResp{easyCon.ERespSuccess, easyCon.ERespTimeout}, 0, []int{2, 3}},
+		{"连接未恢复", 3, []easyCon.EResp{easyCon.ERespUnLinked}, 0, []int{1, 2, 3}},
+		{"对方返回错误也移除", 3, []easyCon.EResp{easyCon.ERespError}, 0, []int{}},
+		{"超出条数丢弃", 5, []easyCon.EResp{easyCon.ERespUnLinked}, 2, []int{4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Queue.File = filepath.Join(t.TempDir(), "outbox.jsonl")
+			config.Queue.MaxCount = tt.max
+			config.Queue.MaxAge = 0
+
+			sent := 0
+			o := newOutboxBll(func(module, route string, content any) easyCon.PackResp {
+				sent++
+				if sent <= len(tt.codes) {
+					return easyCon.PackResp{RespCode: tt.codes[sent-1]}
+				}
+				return easyCon.PackResp{RespCode: easyCon.ERespSuccess}
+			})
+			for i := 1; i <= tt.adds; i++ {
+				o.Add("Route", "Heart", i)
+			}
+			o.Flush()
+
+			want := make([]string, 0)
+			for _, id := range tt.wantIds {
+				want = append(want, strconv.Itoa(id))
+			}
+			if got := outboxContents(o.items); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("items = %v, want %v", got, want)
+			}
+			// 重新加载后与内存中的缓存一致
+			loaded := newOutboxBll(nil)
+			if got := outboxContents(loaded.items); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("reload = %v, want %v", got, want)
+			}
+			// 新的缓存号在已有的之后
+			loaded.Add("Route", "Heart", 0)
+			if last := loaded.items[len(loaded.items)-1].Id; last != uint64(tt.adds+1) {
+				t.Errorf("next id = %d, want %d", last, tt.adds+1)
+			}
+		})
+	}
+}
+
+func TestOutboxLoad(t *testing.T) {
+	item := func(id uint64, content string) string {
+		js, _ := json.Marshal(models.QueueItem{Id: id, Module: "Route", Route: "Heart", Content: json.RawMessage(content)})
+		return string(js)
+	}
+	tests := []struct {
+		name    string
+		file    string
+		wantIds []uint64
+	}{
+		{"旧版Json数组", "[" + item(1, "1") + "," + item(2, "2") + "]", []uint64{1, 2}},
+		{"追加日志", item(1, "1") + "\n" + item(2, "2") + "\n" + `{"Drop":1}` + "\n", []uint64{2}},
+		{"最后一行不完整", item(1, "1") + "\n" + `{"Id":2,"Mod`, []uint64{1}},
+		{"重复的行", item(1, "1") + "\n" + item(1, "1") + "\n", []uint64{1}},
+		{"空文件", "", []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Queue.File = filepath.Join(t.TempDir(), "outbox.jsonl")
+			config.Queue.MaxCount = 0
+			config.Queue.MaxAge = 0
+			if err := os.WriteFile(config.Queue.File, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			o := newOutboxBll(nil)
+			ids := make([]uint64, 0)
+			for _, it := range o.items {
+				ids = append(ids, it.Id)
+			}
+			if len(ids) != len(tt.wantIds) {
+				t.Fatalf("load = %v, want %v", ids, tt.wantIds)
+			}
+			for i := range ids {
+				if ids[i] != tt.wantIds[i] {
+					t.Fatalf("load = %v, want %v", ids, tt.wantIds)
+				}
+			}
+			// 旧版文件加载后转为追加日志
+			if strings.HasPrefix(tt.file, "[") {
+				str, _ := os.ReadFile(config.Queue.File)
+				if strings.HasPrefix(string(str), "[") {
+					t.Errorf("legacy file not compacted: %s", str)
+				}
+			}
+		})
+	}
+}
+
+func outboxContents(items []models.QueueItem) []string {
+	list := make([]string, 0)
+	for _, it := range items {
+		list = append(list, string(it.Content))
+	}
+	return list
+}
@@ -0,0 +1,75 @@
+package blls
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kamioair/qf/qdefine"
+	"router/inner/config"
+	"router/inner/models"
+	"sync"
+	"time"
+)
+
+type pendingItem struct {
+	info models.PendingInfo
+	req  models.RouteInfo
+}
+
+type pending struct {
+	lock  *sync.Mutex
+	items map[string][]pendingItem // 排队的请求，key为等待上线的设备码
+}
+
+func newPendingBll() *pending {
+	return &pending{
+		lock:  &sync.Mutex{},
+		items: map[string][]pendingItem{},
+	}
+}
+
+// Add 请求排队，等待设备上线
+func (p *pending) Add(devId string, req models.RouteInfo) (models.PendingInfo, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	list := p.valid(devId)
+	if config.Offline.QueueMax > 0 && len(list) >= config.Offline.QueueMax {
+		return models.PendingInfo{}, errors.New(fmt.Sprintf("device %s pending queue is full", devId))
+	}
+	info := models.PendingInfo{
+		Id:       uuid.NewString(),
+		DeviceId: devId,
+		Time:     qdefine.NewDateTime(time.Now()),
+	}
+	p.items[devId] = append(list, pendingItem{info: info, req: req})
+	return info, nil
+}
+
+// Take 取出设备排队的请求
+func (p *pending) Take(devId string) []models.RouteInfo {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	list := p.valid(devId)
+	delete(p.items, devId)
+
+	reqs := make([]models.RouteInfo, 0)
+	for _, item := range list {
+		reqs = append(reqs, item.req)
+	}
+	return reqs
+}
+
+// valid 去掉超时的请求
+func (p *pending) valid(devId string) []pendingItem {
+	list := make([]pendingItem, 0)
+	for _, item := range p.items[devId] {
+		if config.Offline.QueueMaxAge > 0 &&
+			time.Since(item.info.Time.ToTime()).Seconds() > float64(config.Offline.QueueMaxAge) {
+			continue
+		}
+		list = append(list, item)
+	}
+	return list
+}
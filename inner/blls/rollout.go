@@ -0,0 +1,311 @@
+package blls
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kamioair/qf/qdefine"
+	"github.com/kamioair/qf/utils/qio"
+	"path/filepath"
+	"router/inner/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 健康检查时忽略的报警，更新过程中版本漂移属于正常现象
+var rolloutIgnoreAlarms = map[string]bool{"VersionDrift": true}
+
+const (
+	rolloutMinWatch  = 30 * time.Second // 最短观察时间，等待模块重启后重新敲门
+	rolloutKnockWait = 5 * time.Minute  // 观察期结束后等待模块以新版本敲门的最长时间
+)
+
+type rollout struct {
+	lock      *sync.Mutex
+	deviceBll *device
+	filesBll  *files
+	streamBll *stream
+	request   func(info models.RouteInfo) (any, error)
+	onNotice  func(route string, content any)
+	states    map[string]*models.RolloutState
+}
+
+func newRolloutBll(deviceBll *device, filesBll *files, streamBll *stream, request func(info models.RouteInfo) (any, error), onNotice func(route string, content any)) *rollout {
+	return &rollout{
+		lock:      &sync.Mutex{},
+		deviceBll: deviceBll,
+		filesBll:  filesBll,
+		streamBll: streamBll,
+		request:   request,
+		onNotice:  onNotice,
+		states:    map[string]*models.RolloutState{},
+	}
+}
+
+// Create 创建分批更新，按设备路径前缀选出已安装该模块的设备
+func (r *rollout) Create(plan models.RolloutPlan) (models.RolloutState, error) {
+	if plan.Module == "" || plan.Version == "" || plan.Package == "" {
+		return models.RolloutState{}, errors.New("rollout module, version or package is nil")
+	}
+	if !qio.PathExists(sandboxPath(plan.Package)) {
+		return models.RolloutState{}, errors.New(fmt.Sprintf("package %s not find", plan.Package))
+	}
+	if plan.WaveSize <= 0 {
+		plan.WaveSize = 1
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, st := range r.states {
+		if st.Plan.Module == plan.Module && st.Status == "Running" {
+			return models.RolloutState{}, errors.New(fmt.Sprintf("module %s is rolling out", plan.Module))
+		}
+	}
+	targets := r.targets(plan)
+	if len(targets) == 0 {
+		return models.RolloutState{}, errors.New("no device matched")
+	}
+
+	st := &models.RolloutState{
+		Id:      uuid.NewString(),
+		Plan:    plan,
+		Status:  "Running",
+		Devices: make([]models.RolloutDevice, 0),
+		Time:    qdefine.NewDateTime(time.Now()),
+	}
+	for i, dev := range targets {
+		st.Devices = append(st.Devices, models.RolloutDevice{
+			Device: dev,
+			Wave:   i/plan.WaveSize + 1,
+			Status: "Pending",
+		})
+	}
+	r.states[st.Id] = st
+	go r.run(st)
+	return r.copyState(st), nil
+}
+
+// targets 按设备路径前缀选出已安装该模块的设备，按路径排序
+func (r *rollout) targets(plan models.RolloutPlan) []string {
+	filter := models.DeviceFilter{Prefix: plan.Prefix}
+	targets := make([]string, 0)
+	for _, knock := range r.deviceBll.GetAllDeviceCache() {
+		if knock.FullUrl == "" || !filter.Match(knock.FullUrl, knock.Tags) {
+			continue
+		}
+		for _, m := range knock.Modules {
+			if m.Name == plan.Module {
+				targets = append(targets, knock.FullUrl)
+				break
+			}
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// GetStates 获取所有分批更新的状态
+func (r *rollout) GetStates() []models.RolloutState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	list := make([]models.RolloutState, 0)
+	for _, st := range r.states {
+		list = append(list, r.copyState(st))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time > list[j].Time
+	})
+	return list
+}
+
+func (r *rollout) run(st *models.RolloutState) {
+	waves := st.Devices[len(st.Devices)-1].Wave
+	for wave := 1; wave <= waves; wave++ {
+		r.update(st, func(s *models.RolloutState) { s.Wave = wave })
+
+		// 记录更新前的报警，用于健康检查
+		baseline := map[string]map[string]bool{}
+		for i, d := range st.Devices {
+			if d.Wave != wave {
+				continue
+			}
+			baseline[d.Device] = r.alarmNames(d.Device)
+			installed, err := r.install(st.Id, st.Plan, d.Device)
+			if installed {
+				r.update(st, func(s *models.RolloutState) { s.Devices[i].Installed = true })
+			}
+			if err != nil {
+				r.setDevice(st, i, "Failed", err)
+				r.fail(st, fmt.Sprintf("%s install failed", d.Device))
+				return
+			}
+			r.setDevice(st, i, "Updated", nil)
+		}
+
+		// 观察期内设备需在线且无新报警，结束时模块需以新版本运行
+		if dev, err := r.watch(st.Plan, baseline); err != nil {
+			for i, d := range st.Devices {
+				if d.Device == dev {
+					r.setDevice(st, i, "Failed", err)
+				}
+			}
+			r.fail(st, fmt.Sprintf("%s health check failed", dev))
+			return
+		}
+	}
+	r.update(st, func(s *models.RolloutState) { s.Status = "Done" })
+}
+
+// install 推送更新包并安装，返回目标设备是否已替换
+func (r *rollout) install(id string, plan models.RolloutPlan, dev string) (bool, error) {
+	target := fmt.Sprintf("packages/%s/%s/%s", plan.Module, plan.Version, filepath.Base(sandboxPath(plan.Package)))
+	sst, err := r.filesBll.Push(models.FileTransfer{
+		Device: dev,
+		Source: plan.Package,
+		Target: target,
+	})
+	if err != nil {
+		return false, err
+	}
+	if sst = r.streamBll.Wait(sst.Id); sst.Status != "Done" {
+		return false, errors.New(fmt.Sprintf("push package failed: %s", sst.Error))
+	}
+	_, err = r.request(models.RouteInfo{
+		Module: dev + "/Route",
+		Route:  "UpdateLocal",
+		Content: models.UpdateRequest{
+			Module:  plan.Module,
+			Version: plan.Version,
+			Package: target,
+			Rollout: id,
+		},
+	})
+	// 超时或断线时无法确定目标设备是否已替换，按已替换处理，回滚时没有备份的设备不会还原
+	return err == nil || isRetryable(err), err
+}
+
+// watch 健康检查，失败时返回出错的设备
+func (r *rollout) watch(plan models.RolloutPlan, baseline map[string]map[string]bool) (string, error) {
+	wait := time.Duration(plan.HealthMinutes) * time.Minute
+	if wait < rolloutMinWatch {
+		wait = rolloutMinWatch
+	}
+	end := time.Now().Add(wait)
+	for {
+		for dev, names := range baseline {
+			id := r.deviceId(dev)
+			if _, offline, _ := r.deviceBll.CheckDevice(id); offline {
+				return dev, errors.New("device offline")
+			}
+			for name := range r.alarmNames(dev) {
+				if !names[name] {
+					return dev, errors.New(fmt.Sprintf("new alarm %s", name))
+				}
+			}
+		}
+		if time.Now().After(end) {
+			// 观察期结束后，等待所有模块以新版本重新敲门
+			dev := ""
+			for d := range baseline {
+				if !r.isRunning(d, plan) {
+					dev = d
+					break
+				}
+			}
+			if dev == "" {
+				return "", nil
+			}
+			if time.Now().After(end.Add(rolloutKnockWait)) {
+				return dev, errors.New(fmt.Sprintf("module %s %s is not running", plan.Module, plan.Version))
+			}
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// fail 回滚所有已替换的设备，使用本次更新的备份
+func (r *rollout) fail(st *models.RolloutState, reason string) {
+	r.update(st, func(s *models.RolloutState) {
+		s.Status = "Failed"
+		s.Error = reason
+	})
+	rolled := true
+	for i, d := range r.copyState(st).Devices {
+		if !d.Installed {
+			continue
+		}
+		rs, err := r.request(models.RouteInfo{
+			Module: d.Device + "/Route",
+			Route:  "RollbackLocal",
+			Content: models.UpdateRequest{
+				Module:  st.Plan.Module,
+				Version: st.Plan.Version,
+				Rollout: st.Id,
+			},
+		})
+		if err != nil {
+			rolled = false
+			r.setDevice(st, i, "Failed", errors.New(fmt.Sprintf("rollback failed: %s", err.Error())))
+			continue
+		}
+		if restored, _ := rs.(bool); restored {
+			r.setDevice(st, i, "RolledBack", nil)
+		}
+	}
+	if rolled {
+		r.update(st, func(s *models.RolloutState) { s.Status = "RolledBack" })
+	}
+}
+
+func (r *rollout) setDevice(st *models.RolloutState, index int, status string, err error) {
+	r.update(st, func(s *models.RolloutState) {
+		s.Devices[index].Status = status
+		if err != nil {
+			s.Devices[index].Error = err.Error()
+		}
+	})
+}
+
+func (r *rollout) update(st *models.RolloutState, fn func(s *models.RolloutState)) {
+	r.lock.Lock()
+	fn(st)
+	cp := r.copyState(st)
+	r.lock.Unlock()
+
+	r.onNotice("RouteRollout", cp)
+}
+
+func (r *rollout) copyState(st *models.RolloutState) models.RolloutState {
+	cp := *st
+	cp.Devices = append([]models.RolloutDevice{}, st.Devices...)
+	return cp
+}
+
+func (r *rollout) deviceId(fullUrl string) string {
+	sp := strings.Split(fullUrl, "/")
+	return sp[len(sp)-1]
+}
+
+func (r *rollout) alarmNames(fullUrl string) map[string]bool {
+	names := map[string]bool{}
+	for _, a := range r.deviceBll.GetAlarmCaches()[r.deviceId(fullUrl)].Alarms {
+		if !rolloutIgnoreAlarms[a.Name] {
+			names[a.Name] = true
+		}
+	}
+	return names
+}
+
+func (r *rollout) isRunning(fullUrl string, plan models.RolloutPlan) bool {
+	knock := r.deviceBll.GetAllDeviceCache()[r.deviceId(fullUrl)]
+	for _, m := range knock.Modules {
+		if m.Name == plan.Module {
+			return m.Version == plan.Version && m.Status == models.EModuleRunning
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package blls
+
+import (
+	"errors"
+	"fmt"
+	"router/inner/models"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRolloutTargets(t *testing.T) {
+	devices := map[string]models.DeviceInfo{
+		"a1": {Id: "a1", FullUrl: "root/a/a1", Modules: models.ModuleCollection{{Name: "Demo"}}},
+		"a2": {Id: "a2", FullUrl: "root/a/a2", Modules: models.ModuleCollection{{Name: "Demo"}, {Name: "Other"}}},
+		"ab": {Id: "ab", FullUrl: "root/ab/b1", Modules: models.ModuleCollection{{Name: "Demo"}}},
+		"c1": {Id: "c1", FullUrl: "root/c/c1", Modules: models.ModuleCollection{{Name: "Other"}}},
+		"x":  {Id: "x", Modules: models.ModuleCollection{{Name: "Demo"}}},
+	}
+	r := &rollout{deviceBll: &device{lock: &sync.Mutex{}, localDevices: devices}}
+
+	tests := []struct {
+		name   string
+		prefix string
+		module string
+		want   []string
+	}{
+		{"全部设备", "", "Demo", []string{"root/a/a1", "root/a/a2", "root/ab/b1"}},
+		{"按层级匹配", "root/a", "Demo", []string{"root/a/a1", "root/a/a2"}},
+		{"前缀带分隔符", "/root/a/", "Demo", []string{"root/a/a1", "root/a/a2"}},
+		{"单个设备", "root/a/a1", "Demo", []string{"root/a/a1"}},
+		{"只选已安装的设备", "root", "Other", []string{"root/a/a2", "root/c/c1"}},
+		{"没有匹配", "root/d", "Demo", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := r.targets(models.RolloutPlan{Prefix: tt.prefix, Module: tt.module})
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("targets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRolloutFail(t *testing.T) {
+	tests := []struct {
+		name       string
+		installed  []bool
+		errs       map[string]error // 回滚出错的设备
+		restored   bool             // 目标设备是否有备份可还原
+		wantCalls  []string
+		wantStatus string
+		wantDevice []string
+	}{
+		{"只回滚已替换的设备", []bool{true, false}, nil, true, []string{"d1"}, "RolledBack", []string{"RolledBack", "Pending"}},
+		{"没有备份", []bool{true}, nil, false, []string{"d1"}, "RolledBack", []string{"Pending"}},
+		{"回滚失败", []bool{true, true}, map[string]error{"d1": errors.New("offline")}, true, []string{"d1", "d2"}, "Failed", []string{"Failed", "RolledBack"}},
+		{"没有已替换的设备", []bool{false, false}, nil, true, []string{}, "RolledBack", []string{"Pending", "Pending"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := make([]string, 0)
+			r := &rollout{
+				lock: &sync.Mutex{},
+				request: func(info models.RouteInfo) (any, error) {
+					dev := strings.TrimSuffix(info.Module, "/Route")
+					calls = append(calls, dev)
+					if err := tt.errs[dev]; err != nil {
+						return nil, err
+					}
+					return tt.restored, nil
+				},
+				onNotice: func(route string, content any) {},
+			}
+			st := &models.RolloutState{Id: "r1", Plan: models.RolloutPlan{Module: "Demo"}, Status: "Running"}
+			for i, installed := range tt.installed {
+				st.Devices = append(st.Devices, models.RolloutDevice{Device: fmt.Sprintf("d%d", i+1), Status: "Pending", Installed: installed})
+			}
+			r.fail(st, "failed")
+
+			if strings.Join(calls, ",") != strings.Join(tt.wantCalls, ",") {
+				t.Errorf("rollback calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if st.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", st.Status, tt.wantStatus)
+			}
+			for i, d := range st.Devices {
+				if d.Status != tt.wantDevice[i] {
+					t.Errorf("device %s status = %s, want %s", d.Device, d.Status, tt.wantDevice[i])
+				}
+			}
+		})
+	}
+}
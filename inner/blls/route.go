@@ -7,19 +7,41 @@ import (
 	"github.com/google/uuid"
 	"github.com/kamioair/qf/qdefine"
 	"github.com/kamioair/qf/utils/qconvert"
+	"github.com/kamioair/qf/utils/qio"
 	easyCon "github.com/qiu-tec/easy-con.golang"
+	"os"
+	"path/filepath"
 	"router/inner/config"
 	"router/inner/models"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 type Route struct {
-	upperAdapter easyCon.IAdapter // 上层Broker访问器
+	uplinkBll    *uplink          // 上层Broker访问器
 	localAdapter easyCon.IAdapter // 自己Broker访问器
 	lock         *sync.Mutex
 	deviceBll    *device
+	noticeBll    *notice
+	outboxBll    *outbox
+	tracerBll    *tracer
+	pendingBll   *pending
+	streamBll    *stream
+	filesBll     *files
+	execBll      *executor
+	logsBll      *logs
+	lifecycleBll *lifecycle
+	controlBll   *controller
+	updaterBll   *updater
+	rolloutBll   *rollout
+	enrollBll    *enroll
+	identityBll  *identity
+	credBll      *credential
+	signBll      *signature
+	lastHeart    string    // 最后一次上报的报警内容
+	started      time.Time // 启动时间，启动后一个心跳周期内下级可能尚未敲门
 	onNotice     func(route string, content any)
 }
 
@@ -29,26 +51,33 @@ func NewRouteBll(localAdapter easyCon.IAdapter, onNotice func(route string, cont
 		onNotice:     onNotice,
 	}
 	// 如果有上层配置，则连接
-	if config.UpMqtt.Addr != "" {
-		setting := easyCon.NewSetting(fmt.Sprintf("Route.%s", config.DeviceId()), config.UpMqtt.Addr, r.onReq, r.onStatus)
-		setting.UID = config.UpMqtt.UId
-		setting.PWD = config.UpMqtt.Pwd
-		setting.TimeOut = time.Duration(config.UpMqtt.TimeOut) * time.Second
-		setting.ReTry = config.UpMqtt.Retry
-		setting.LogMode = easyCon.ELogMode(config.UpMqtt.LogMode)
-		r.upperAdapter = easyCon.NewMqttAdapter(setting)
-		time.Sleep(time.Second)
-	}
+	r.uplinkBll = newUplinkBll(r.connectUpper, r.onUplinkLinked)
 	// 其他初始化
-	r.deviceBll = newDeviceBll()
+	r.logsBll = newLogsBll()
+	r.deviceBll = newDeviceBll(r.logsBll, r.onDeviceOnline)
+	r.lifecycleBll = newLifecycleBll(r.deviceBll, r.probeModule, r.onModuleChanged)
+	r.controlBll = newControllerBll(r.exitModule, r.probeModule)
+	r.enrollBll = newEnrollBll()
+	r.identityBll = newIdentityBll()
+	r.credBll = newCredentialBll()
+	r.signBll = newSignatureBll(r.isRoot, r.fetchKey)
+	r.pendingBll = newPendingBll()
+	r.streamBll = newStreamBll(r.deviceBll, r.Request, r.onStreamComplete)
+	r.filesBll = newFilesBll(r.deviceBll, r.streamBll, r.Request, r.onNotice)
+	r.execBll = newExecutorBll(r.deviceBll)
+	r.updaterBll = newUpdaterBll(r.controlBll)
+	r.rolloutBll = newRolloutBll(r.deviceBll, r.filesBll, r.streamBll, r.Request, r.onNotice)
+	r.outboxBll = newOutboxBll(r.upSend)
+	r.tracerBll = newTracerBll()
+	r.noticeBll = newNoticeBll(r.localAdapter, r.uplinkBll.Adapter, r.deviceBll, r.postUp)
 	return r
 }
 
 // Start 启动
 func (r *Route) Start() {
-	if r.upperAdapter != nil {
+	if r.uplinkBll.Configured() {
 		// 服务路由，问上层路由要
-		resp := r.upperAdapter.Req("Route", "GetDeviceCache", nil)
+		resp := r.upSend("Route", "GetDeviceCache", nil)
 		if resp.RespCode == easyCon.ERespSuccess {
 			r.deviceBll.SetUpperDevice(qconvert.ToAny[models.DeviceKnock](resp.Content))
 		}
@@ -60,27 +89,118 @@ func (r *Route) Start() {
 		}
 	}
 	// 启动设备
+	r.started = time.Now()
 	r.deviceBll.Start()
+	// 开启审批前已登记的设备视为审批通过
+	if config.Enroll.Enabled && r.isRoot() {
+		if n := r.enrollBll.Seed(r.deviceBll.RegisteredIds()); n > 0 {
+			fmt.Printf("[Enroll]:%d registered devices approved\n", n)
+		}
+	}
+	// 启动模块状态检测
+	r.lifecycleBll.Start()
+	// 启动通知转发
+	r.noticeBll.Start()
+	// 启动追踪导出
+	r.tracerBll.Start()
+	// 启动数据流清理
+	r.streamBll.Start()
 	// 启动心跳
 	go r.heartLoop()
+	// 上级Broker健康检查
+	r.uplinkBll.Start()
+	if r.uplinkBll.Configured() {
+		go r.uplinkAlarmLoop()
+	}
+	// 检查上级连接的证书到期
+	if r.uplinkBll.Configured() {
+		go r.certLoop()
+	}
+	// 临时设备码连通后向上级确认
+	if config.IsProvisional() {
+		go r.confirmLoop()
+	}
+	// 定期更换设备凭证
+	if !r.isRoot() && config.Credential.RotateDays > 0 {
+		go r.credentialLoop()
+	}
+	// 向根路由登记签名公钥
+	if !r.isRoot() && config.Sign.Enabled {
+		go r.registerKeyLoop()
+	}
+	go r.signAlarmLoop()
 }
 
-// KnockDoor 敲门处理
-func (r *Route) KnockDoor(doors map[string]models.DeviceKnock) (map[string]string, error) {
+// connectUpper 连接上层Broker，开启Broker认证且已有凭证时使用设备码和凭证登录，name为空时使用路由的模块名称
+func (r *Route) connectUpper(broker config.UpBroker, name string) (easyCon.IAdapter, error) {
+	onReq := r.onReq
+	if name == "" {
+		name = fmt.Sprintf("Route.%s", config.DeviceId())
+	} else {
+		// 临时连接不处理请求
+		onReq = func(easyCon.PackReq) (easyCon.EResp, any) {
+			return easyCon.ERespRouteNotFind, nil
+		}
+	}
+	setting := easyCon.NewSetting(name, broker.Addr, onReq, r.onStatus)
+	setting.UID = broker.UId
+	setting.PWD = broker.Pwd
+	if cred, _ := config.DeviceCredential(); config.Credential.BrokerAuth && cred != "" {
+		setting.UID = config.DeviceId()
+		setting.PWD = cred
+	}
+	setting.TimeOut = time.Duration(broker.TimeOut) * time.Second
+	setting.ReTry = broker.Retry
+	setting.LogMode = easyCon.ELogMode(broker.LogMode)
+	return config.NewUpAdapter(broker, setting)
+}
+
+// onUplinkLinked 上级Broker恢复连接或切换后，重新获取上级设备信息并敲门
+func (r *Route) onUplinkLinked() {
+	resp := r.upSend("Route", "GetDeviceCache", nil)
+	if resp.RespCode == easyCon.ERespSuccess {
+		r.deviceBll.SetUpperDevice(qconvert.ToAny[models.DeviceKnock](resp.Content))
+	}
+	r.ReKnockDoor()
+	// 上级的订阅只在内存中，重连、切换或上级重启后重新登记
+	go r.noticeBll.pushUpper()
+	go r.outboxBll.Flush()
+	r.onNotice("RouteUplinkChanged", r.uplinkBll.State())
+}
+
+// KnockDoor 敲门处理，signer为签名的下级路由，未签名时为空
+func (r *Route) KnockDoor(signer string, doors map[string]models.DeviceKnock) (map[string]string, error) {
+	for id := range doors {
+		if !r.isEnrolled(id) {
+			delete(doors, id)
+			continue
+		}
+		// 要求签名时，未签名的敲门只接受本机模块
+		if signer == "" && config.Sign.Required && id != config.DeviceId() {
+			_ = r.signBll.Reject(id, "unsigned message")
+			delete(doors, id)
+			continue
+		}
+		if signer != "" && !r.inSubtree(signer, id, doors[id].FullUrl) {
+			_ = r.signBll.Reject(signer, "device out of subtree")
+			delete(doors, id)
+		}
+	}
 	// 添加到缓存
 	list := r.deviceBll.SetLocalDevice(doors)
+	if r.deviceBll.CheckDrift() {
+		r.onNotice("RouteDeviceAlarm", qdefine.NewDateTime(time.Now()))
+	}
 
 	// 客户端路由向服务器根路由敲门
 	if config.Mode.IsClient() {
-		r.localAdapter.Req("Route", "KnockDoor", list)
+		r.postUp("Route", "KnockDoor", list)
 		// 返回上级的模块列表
 		return r.deviceBll.GetUpperModules(), nil
 	}
 
 	// 服务路由且配置了上级Broker，向上级路由敲门
-	if r.upperAdapter != nil {
-		go r.upperAdapter.Req("Route", "KnockDoor", list)
-	}
+	go r.postUp("Route", "KnockDoor", list)
 	return map[string]string{}, nil
 }
 
@@ -88,21 +208,390 @@ func (r *Route) KnockDoor(doors map[string]models.DeviceKnock) (map[string]strin
 func (r *Route) ReKnockDoor() {
 	list := r.deviceBll.GetAllDeviceCache()
 
-	// 客户端路由向服务器根路由敲门
+	// 客户端路由向服务器根路由敲门，服务路由且配置了上级Broker，向上级路由敲门
+	go r.postUp("Route", "KnockDoor", list)
+}
+
+// LeaveDoor 模块退出处理
+func (r *Route) LeaveDoor(doors map[string]models.DeviceKnock) (bool, error) {
+	list := r.deviceBll.LeaveModules(doors)
+	if r.deviceBll.CheckDrift() {
+		r.onNotice("RouteDeviceAlarm", qdefine.NewDateTime(time.Now()))
+	}
+
+	// 将状态变化继续向上级路由敲门
+	go r.postUp("Route", "KnockDoor", list)
+	return true, nil
+}
+
+// probeModule 探测本机模块，有任何应答即视为存活
+func (r *Route) probeModule(name string) bool {
+	resp := r.localAdapter.Req(fmt.Sprintf("%s.%s", name, config.DeviceId()), "Ping", nil)
+	return resp.RespCode != easyCon.ERespTimeout && resp.RespCode != easyCon.ERespUnLinked
+}
+
+func (r *Route) onModuleChanged(info models.ModuleInfo) {
+	r.onNotice("RouteModuleChanged", info)
+	r.ReKnockDoor()
+}
+
+// NewDeviceId 给下级路由分配一个新的设备ID
+func (r *Route) NewDeviceId(req models.EnrollRequest) (any, error) {
+	// 由根路由统一分配
+	if r.uplinkBll.Configured() {
+		return r.upRequestFunc("Route", "NewDeviceId", req)
+	}
+	if config.Enroll.Enabled {
+		id, err := r.enrollBll.Request(req)
+		if err != nil {
+			return nil, err
+		}
+		r.identityBll.Record(id, req.Hardware)
+		return r.grant(id, req)
+	}
+	// 重装的设备按硬件信息找回之前的设备码，已有凭证的需校验凭证，否则返回新的ID
+	id := r.identityBll.Lookup(req.Hardware, r.deviceBll.IsAlive)
+	if id == "" || !r.isOwner(id, req) {
+		id = uuid.NewString()
+	}
+	r.identityBll.Record(id, req.Hardware)
+	return r.grant(id, req)
+}
+
+// ConfirmDeviceId 确认下级路由本地生成的临时设备码，冲突时分配新的
+func (r *Route) ConfirmDeviceId(req models.EnrollRequest) (any, error) {
+	if r.uplinkBll.Configured() {
+		return r.upRequestFunc("Route", "ConfirmDeviceId", req)
+	}
+	// 申请方自选的设备码与已分配的设备码相同时，只有提供该设备当前凭证才能沿用，避免冒用其他设备
+	if r.isIssued(req.DeviceId) && !(r.credBll.Has(req.DeviceId) && r.isOwner(req.DeviceId, req)) {
+		req.DeviceId = uuid.NewString()
+	}
+	if config.Enroll.Enabled {
+		id, err := r.enrollBll.Request(req)
+		if err != nil {
+			return nil, err
+		}
+		r.identityBll.Record(id, req.Hardware)
+		return r.grant(id, req)
+	}
+	id := r.identityBll.Lookup(req.Hardware, r.deviceBll.IsAlive)
+	if id != "" && !r.isOwner(id, req) {
+		id = ""
+	}
+	if id == "" {
+		id = req.DeviceId
+	}
+	r.identityBll.Record(id, req.Hardware)
+	return r.grant(id, req)
+}
+
+// grant 登记设备的签名公钥，开启凭证签发时连同新签发的凭证一起返回，否则只返回设备码以兼容旧版本
+func (r *Route) grant(id string, req models.EnrollRequest) (any, error) {
+	if !r.isOwner(id, req) {
+		return nil, models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), "device id already has a credential")
+	}
+	if err := r.registerKey(id, req.PublicKey, req.Credential); err != nil {
+		return nil, err
+	}
+	if !config.Credential.Enabled {
+		return id, nil
+	}
+	cred, err := r.credBll.Issue(id)
+	if err != nil {
+		return nil, err
+	}
+	return models.DeviceGrant{DeviceId: id, Credential: cred}, nil
+}
+
+// isIssued 设备码是否已由根路由分配或确认过，包括记录过硬件信息、已签发凭证和审批通过的设备
+// 临时设备码在确认前也会心跳和敲门，因此不按在线和登记信息判断
+func (r *Route) isIssued(id string) bool {
+	if id == "" || id == "root" || id == config.DeviceId() {
+		return true
+	}
+	return r.identityBll.Has(id) || r.credBll.Has(id) || (config.Enroll.Enabled && r.enrollBll.IsApproved(id))
+}
+
+// isOwner 申请方是否可以使用该设备码，已签发凭证的设备码需提供当前凭证
+func (r *Route) isOwner(id string, req models.EnrollRequest) bool {
+	if !r.credBll.Has(id) {
+		return true
+	}
+	return r.credBll.Verify(models.CredentialCheck{DeviceId: id, Credential: req.Credential})
+}
+
+// RotateCredential 校验设备当前的凭证后签发新凭证
+func (r *Route) RotateCredential(req models.CredentialCheck) (any, error) {
+	if r.uplinkBll.Configured() {
+		return r.upRequestFunc("Route", "RotateCredential", req)
+	}
+	if !config.Credential.Enabled {
+		return models.DeviceGrant{DeviceId: req.DeviceId}, nil
+	}
+	cred, err := r.credBll.Rotate(req)
+	if err != nil {
+		return nil, err
+	}
+	return models.DeviceGrant{DeviceId: req.DeviceId, Credential: cred}, nil
+}
+
+// VerifyCredential 校验设备凭证，供Broker的认证插件调用
+func (r *Route) VerifyCredential(req models.CredentialCheck) (any, error) {
+	if r.uplinkBll.Configured() {
+		return r.upRequestFunc("Route", "VerifyCredential", req)
+	}
+	return r.credBll.Verify(req), nil
+}
+
+// RemoveDevice 从根路由移除设备并吊销凭证
+func (r *Route) RemoveDevice(id string) (any, error) {
+	if id == "" || id == config.DeviceId() {
+		return nil, errors.New("device id is invalid")
+	}
+	removed := r.deviceBll.RemoveDevice(id)
+	revoked := r.credBll.Revoke(id)
+	if r.signBll.Unregister(id) {
+		revoked = true
+	}
+	if !removed && !revoked {
+		return nil, errors.New(fmt.Sprintf("device %s not find", id))
+	}
+	r.onNotice("RouteDeviceAlarm", qdefine.NewDateTime(time.Now()))
+	return true, nil
+}
+
+// RegisterKey 登记设备的签名公钥，需校验设备凭证，没有凭证的设备只能在分配设备码时登记
+func (r *Route) RegisterKey(req models.DeviceKey) (any, error) {
+	if r.uplinkBll.Configured() {
+		return r.upRequestFunc("Route", "RegisterKey", req)
+	}
+	if req.DeviceId == "" || req.PublicKey == "" {
+		return nil, errors.New("device id or public key is nil")
+	}
+	if !r.credBll.Has(req.DeviceId) {
+		return nil, models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), "credential is not issued")
+	}
+	if err := r.registerKey(req.DeviceId, req.PublicKey, req.Credential); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// registerKey 登记设备公钥的唯一入口，已签发凭证的设备需校验当前凭证
+// 没有凭证的设备只在分配设备码时调用，由审批或硬件信息确认申请方
+func (r *Route) registerKey(id, pub, cred string) error {
+	if pub == "" || r.signBll.GetKey(id) == pub {
+		return nil
+	}
+	if r.credBll.Has(id) && !r.credBll.Verify(models.CredentialCheck{DeviceId: id, Credential: cred}) {
+		return models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), "credential is invalid")
+	}
+	r.signBll.Register(id, pub)
+	return nil
+}
+
+// GetDeviceKey 获取设备的签名公钥，供下级路由验签
+func (r *Route) GetDeviceKey(id string) (any, error) {
+	return r.signBll.GetKey(id), nil
+}
+
+// Unseal 解开下级路由发送的消息，已签名的校验后返回签名设备，未签名的返回空
+// 带签名或随机数的视为已签名，必须通过校验，未签名消息中的Id是内容本身的字段，不能作为签名设备
+func (r *Route) Unseal(route string, content any, out any) (string, error) {
+	msg, _ := qconvert.ToAnyError[models.SignedMessage](content)
+	signer := ""
+	var body []byte
+	if msg.Sig == "" && msg.Nonce == "" {
+		js, err := json.Marshal(content)
+		if err != nil {
+			return "", err
+		}
+		body = js
+	} else {
+		js, err := r.signBll.Verify(route, msg)
+		if err != nil {
+			return "", models.NewRouteError(models.ERouteErrAccessDenied, msg.Id, err.Error())
+		}
+		body = js
+		signer = msg.Id
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return "", err
+	}
+	return signer, nil
+}
+
+func (r *Route) fetchKey(devId string) string {
+	resp := r.upSend("Route", "GetDeviceKey", map[string]string{"id": devId})
+	if resp.RespCode != easyCon.ERespSuccess {
+		return ""
+	}
+	return qconvert.ToAny[string](resp.Content)
+}
+
+// registerKeyLoop 按指数退避向根路由登记签名公钥，直到成功
+func (r *Route) registerKeyLoop() {
+	wait := time.Second
+	for {
+		cred, _ := config.DeviceCredential()
+		if cred == "" {
+			// 没有凭证时公钥在分配设备码时已登记
+			return
+		}
+		resp := r.upSend("Route", "RegisterKey", models.DeviceKey{
+			DeviceId:   config.DeviceId(),
+			PublicKey:  config.PublicKey(),
+			Credential: cred,
+		})
+		if resp.RespCode == easyCon.ERespSuccess {
+			return
+		}
+		fmt.Printf("[Sign]:register public key failed, %v %s\n", resp.RespCode, resp.Error)
+		time.Sleep(wait)
+		if wait *= 2; wait > time.Minute {
+			wait = time.Minute
+		}
+	}
+}
+
+// signAlarmLoop 验签失败时报警
+func (r *Route) signAlarmLoop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	last := ""
+	for range ticker.C {
+		if alarm := r.signBll.Alarm(); alarm != last {
+			last = alarm
+			r.deviceBll.SetAlarm("SignatureInvalid", alarm)
+		}
+	}
+}
+
+// credentialLoop 凭证超过更换周期或尚未签发时，向根路由申请新凭证
+func (r *Route) credentialLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		cred, at := config.DeviceCredential()
+		// 没有凭证的设备只能在分配设备码时获取，不能通过更换获取
+		due := cred != "" && time.Since(at.ToTime()) > time.Duration(config.Credential.RotateDays)*24*time.Hour
+		if due && !config.IsProvisional() {
+			resp := r.upSend("Route", "RotateCredential", models.CredentialCheck{DeviceId: config.DeviceId(), Credential: cred})
+			if resp.RespCode == easyCon.ERespSuccess {
+				grant := models.ToDeviceGrant(resp.Content)
+				if grant.Credential != "" {
+					if err := config.SetDeviceCredential(grant.Credential); err != nil {
+						fmt.Println("[Credential]:", err.Error())
+					} else if config.Credential.BrokerAuth && r.uplinkBll.Configured() {
+						// 使用新凭证重新连接
+						r.uplinkBll.Reconnect()
+					}
+				}
+			} else {
+				fmt.Printf("[Credential]:rotate failed, %v %s\n", resp.RespCode, resp.Error)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// ReprovisionDevice 让目标设备重新申请设备码，用于处理设备码重复
+func (r *Route) ReprovisionDevice(req models.Reprovision) (any, error) {
+	if req.Device == "" {
+		return nil, errors.New("device is nil")
+	}
+	return r.Request(models.RouteInfo{
+		Module:  req.Device + "/Route",
+		Route:   "ReprovisionLocal",
+		Content: req,
+	})
+}
+
+// reprovisionLocal 向上级重新申请设备码并保存，重启后生效
+func (r *Route) reprovisionLocal(req models.Reprovision) (any, error) {
+	if req.Instance != "" && req.Instance != config.InstanceId() {
+		// 设备码重复时，请求可能到达另一台设备
+		return false, nil
+	}
+	rs, err := r.upRequestFunc("Route", "NewDeviceId", config.NewEnrollRequest(""))
+	if err != nil {
+		return nil, err
+	}
+	grant := models.ToDeviceGrant(rs)
+	id := grant.DeviceId
+	if id == "" || id == config.DeviceId() {
+		return nil, errors.New("no new device id assigned")
+	}
+	if _, err = config.ConfirmDeviceId(grant); err != nil {
+		return nil, err
+	}
+	if req.Restart {
+		go r.restart()
+	}
+	return id, nil
+}
+
+// restart 让路由退出，由守护进程重新启动
+func (r *Route) restart() {
+	time.Sleep(500 * time.Millisecond)
+	name := "Route"
 	if config.Mode.IsClient() {
-		r.localAdapter.Req("Route", "KnockDoor", list)
+		name = fmt.Sprintf("Route.%s", config.DeviceId())
 	}
+	r.localAdapter.Req(name, "Exit", nil)
+}
 
-	// 服务路由且配置了上级Broker，向上级路由敲门
-	if r.upperAdapter != nil {
-		go r.upperAdapter.Req("Route", "KnockDoor", list)
+// IdentityConflicts 获取硬件信息冲突报告
+func (r *Route) IdentityConflicts() (any, error) {
+	return r.identityBll.GetConflicts(), nil
+}
+
+// PendingDevices 获取设备登记申请
+func (r *Route) PendingDevices() (any, error) {
+	return r.enrollBll.GetList(), nil
+}
+
+// ApproveDevice 审批通过设备登记申请
+func (r *Route) ApproveDevice(id string) (any, error) {
+	return r.enrollBll.Approve(id)
+}
+
+// RejectDevice 拒绝设备登记申请
+func (r *Route) RejectDevice(id string) (any, error) {
+	return r.enrollBll.Reject(id)
+}
+
+// isEnrolled 开启审批后，仅接受审批通过的设备
+func (r *Route) isEnrolled(devId string) bool {
+	if !config.Enroll.Enabled || r.uplinkBll.Configured() || config.Mode.IsClient() {
+		return true
 	}
+	return devId == config.DeviceId() || r.enrollBll.IsApproved(devId)
 }
 
-// NewDeviceId 给下级路由分配一个新的设备ID
-func (d *Route) NewDeviceId() (any, error) {
-	// 返回新的ID
-	return uuid.NewString(), nil
+// confirmLoop 按指数退避向上级确认临时设备码，直到成功
+func (r *Route) confirmLoop() {
+	wait := time.Second
+	for {
+		resp := r.upSend("Route", "ConfirmDeviceId", config.NewEnrollRequest(config.DeviceId()))
+		if resp.RespCode == easyCon.ERespSuccess {
+			changed, err := config.ConfirmDeviceId(models.ToDeviceGrant(resp.Content))
+			if err != nil {
+				fmt.Println("[Provision]:", err.Error())
+			} else if changed {
+				// 根路由分配了新的设备码，重启后使用新的设备码和凭证
+				r.restart()
+			}
+			return
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > time.Minute {
+			wait = time.Minute
+		}
+	}
 }
 
 // AddAlarm 写入警报
@@ -119,9 +608,21 @@ func (r *Route) GetDeviceCache() (models.DeviceKnock, error) {
 // Request 执行路由请求
 func (r *Route) Request(info models.RouteInfo) (any, error) {
 	if info.Module == "" {
-		return nil, errors.New("moduleName is nil")
+		return nil, models.NewRouteError(models.ERouteErrNotFound, config.DeviceId(), "moduleName is nil")
 	}
 
+	if info.Origin == "" {
+		// 请求方由首个经过的路由填写
+		info.Origin = r.deviceBll.GetFullUrl(config.DeviceId())
+	}
+
+	// 记录本跳的追踪信息，失败时返回经过的路由列表
+	span := r.tracerBll.Begin(&info)
+	rs, err := r.request(info)
+	return rs, r.tracerBll.End(span, err)
+}
+
+func (r *Route) request(info models.RouteInfo) (any, error) {
 	// 非路由请求
 	if strings.Contains(info.Module, "/") == false {
 		rs, err := r.upRequestFunc(info.Module, info.Route, info.Content)
@@ -135,23 +636,467 @@ func (r *Route) Request(info models.RouteInfo) (any, error) {
 	return r.routeRequest(info)
 }
 
-func (r *Route) AddHeart(id string, info map[string]models.DeviceAlarm) {
-	isChanged := r.deviceBll.AddHeart(id, info)
+// SubscribeNotice 登记跨路由通知订阅
+func (r *Route) SubscribeNotice(info models.NoticeInterest) (any, error) {
+	return r.noticeBll.Subscribe(info)
+}
+
+// ForwardNotice 处理下级路由转发上来的通知
+func (r *Route) ForwardNotice(fw models.NoticeForward) (any, error) {
+	r.noticeBll.Forward(fw, false)
+	return true, nil
+}
+
+// Post 执行不等待结果的路由请求，上行不通时写入离线缓存
+func (r *Route) Post(info models.RouteInfo) (any, error) {
+	if info.Module == "" {
+		return nil, errors.New("moduleName is nil")
+	}
+
+	// 非路由请求，直接向上
+	if strings.Contains(info.Module, "/") == false {
+		go r.postUp(info.Module, info.Route, info.Content)
+		return true, nil
+	}
+
+	// 路由请求，判断是否需要向上
+	devCode := config.DeviceId()
+	sp := strings.Split(info.Module, "/")
+	if sp[0] != devCode && devCode != "root" && devCode != "" {
+		newParams := map[string]any{}
+		newParams["Module"] = info.Module
+		newParams["Route"] = info.Route
+		newParams["Content"] = info.Content
+		newParams["Trace"] = info.Trace
+		go r.postUp("Route", "Request", newParams)
+		return true, nil
+	}
+	go r.routeRequest(info)
+	return true, nil
+}
+
+// StreamOpen 打开数据流（接收方）
+func (r *Route) StreamOpen(open models.StreamOpen) (any, error) {
+	return r.streamBll.Open(open)
+}
+
+// StreamChunk 写入数据块（接收方）
+func (r *Route) StreamChunk(chunk models.StreamChunk) (any, error) {
+	return r.streamBll.Chunk(chunk)
+}
+
+// StreamClose 关闭数据流（接收方）
+func (r *Route) StreamClose(c models.StreamClose) (any, error) {
+	return r.streamBll.Close(c)
+}
+
+// GetStreams 获取数据流传输状态
+func (r *Route) GetStreams() (any, error) {
+	return r.streamBll.GetStreams(), nil
+}
+
+// SendStream 将本机沙箱中的文件作为通用数据流发送到目标设备
+func (r *Route) SendStream(req models.StreamSend) (any, error) {
+	if req.Device == "" || req.Source == "" {
+		return nil, errors.New("stream send args is nil")
+	}
+	source := sandboxPath(req.Source)
+	name := req.Name
+	if name == "" {
+		name = filepath.Base(source)
+	}
+	meta := map[string]string{}
+	for k, v := range req.Meta {
+		meta[k] = v
+	}
+	// 类型由路由使用，不能借通用数据流写入沙箱或更新模块
+	delete(meta, "Kind")
+	return r.streamBll.Send(req.Device, source, name, meta)
+}
+
+// PushFile 推送文件到目标设备
+func (r *Route) PushFile(info models.FileTransfer) (any, error) {
+	return r.filesBll.Push(info)
+}
+
+// PullFile 从目标设备拉取文件
+func (r *Route) PullFile(info models.FileTransfer) (any, error) {
+	return r.filesBll.Pull(info)
+}
+
+// Exec 在目标设备执行命令
+func (r *Route) Exec(req models.ExecRequest) (any, error) {
+	if req.Device == "" || req.Command == "" {
+		return nil, errors.New("exec device or command is nil")
+	}
+	return r.Request(models.RouteInfo{
+		Module:  req.Device + "/Route",
+		Route:   "ExecLocal",
+		Content: req,
+	})
+}
+
+// execLocal 在本机执行命令，并上报审计
+func (r *Route) execLocal(req models.ExecRequest) (any, error) {
+	result, err := r.execBll.Run(req)
+	rs := fmt.Sprintf("exit %d", result.ExitCode)
+	if err != nil {
+		rs = err.Error()
+	} else if result.Error != "" {
+		rs = result.Error
+	}
+	_, _ = r.AddAudit(models.AuditRecord{
+		Time:   qdefine.NewDateTime(time.Now()),
+		Device: result.Device,
+		From:   req.From,
+		Action: "Exec",
+		Target: req.Command,
+		Args:   req.Args,
+		Result: rs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ModuleControl 启动、停止或重启目标设备上的模块
+func (r *Route) ModuleControl(req models.ModuleControl) (any, error) {
+	if req.Device == "" || req.Module == "" || req.Action == "" {
+		return nil, errors.New("control device, module or action is nil")
+	}
+	return r.Request(models.RouteInfo{
+		Module:  req.Device + "/Route",
+		Route:   "ControlLocal",
+		Content: req,
+	})
+}
+
+// controlLocal 控制本机模块，更新登记状态并上报审计
+func (r *Route) controlLocal(req models.ModuleControl) (any, error) {
+	status, err := r.controlBll.Do(req.Module, req.Action)
+	rs := string(status)
+	if err != nil {
+		rs = err.Error()
+	}
+	_, _ = r.AddAudit(models.AuditRecord{
+		Time:   qdefine.NewDateTime(time.Now()),
+		Device: r.deviceBll.GetFullUrl(config.DeviceId()),
+		From:   req.From,
+		Action: "ModuleControl",
+		Target: req.Module,
+		Args:   []string{req.Action},
+		Result: rs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 通过敲门登记同步新的状态
+	if info, changed := r.deviceBll.SetModuleStatus(req.Module, status); changed {
+		r.onModuleChanged(info)
+	}
+	return models.ModuleControlResult{
+		Device: r.deviceBll.GetFullUrl(config.DeviceId()),
+		Module: req.Module,
+		Action: req.Action,
+		Status: status,
+	}, nil
+}
+
+// CreateRollout 创建模块分批更新
+func (r *Route) CreateRollout(plan models.RolloutPlan) (any, error) {
+	return r.rolloutBll.Create(plan)
+}
+
+// GetRollouts 获取分批更新状态
+func (r *Route) GetRollouts() (any, error) {
+	return r.rolloutBll.GetStates(), nil
+}
+
+// updateLocal 更新本机模块并上报审计
+func (r *Route) updateLocal(req models.UpdateRequest) (any, error) {
+	err := r.updaterBll.Install(req)
+	r.auditUpdate("ModuleUpdate", req, err)
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// rollbackLocal 回滚本机模块并上报审计
+func (r *Route) rollbackLocal(req models.UpdateRequest) (any, error) {
+	// 先标记，模块可能在回滚返回前就已重新敲门
+	r.deviceBll.ExpectRollback(req.Module, true)
+	restored, err := r.updaterBll.Rollback(req.Module, req.Rollout)
+	if !restored {
+		r.deviceBll.ExpectRollback(req.Module, false)
+	}
+	r.auditUpdate("ModuleRollback", req, err)
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+func (r *Route) auditUpdate(action string, req models.UpdateRequest, err error) {
+	rs := "ok"
+	if err != nil {
+		rs = err.Error()
+	}
+	_, _ = r.AddAudit(models.AuditRecord{
+		Time:   qdefine.NewDateTime(time.Now()),
+		Device: r.deviceBll.GetFullUrl(config.DeviceId()),
+		From:   req.From,
+		Action: action,
+		Target: req.Module,
+		Args:   []string{req.Version},
+		Result: rs,
+	})
+}
+
+// exitModule 请求本机模块退出
+func (r *Route) exitModule(name string) bool {
+	resp := r.localAdapter.Req(fmt.Sprintf("%s.%s", name, config.DeviceId()), "Exit", nil)
+	return resp.RespCode == easyCon.ERespSuccess
+}
+
+// AuditLog 下级路由上报的审计记录，只接受签名的下级路由上报自己子树中设备的记录
+func (r *Route) AuditLog(signer string, rec models.AuditRecord) (any, error) {
+	if signer == "" {
+		return nil, models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), r.signBll.Reject(rec.Device, "unsigned message").Error())
+	}
+	if !r.inSubtree(signer, "", rec.Device) {
+		return nil, models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), r.signBll.Reject(signer, "device out of subtree").Error())
+	}
+	return r.AddAudit(rec)
+}
+
+// AddAudit 写入审计记录，逐级上报到根路由保存
+func (r *Route) AddAudit(rec models.AuditRecord) (any, error) {
+	if !r.isRoot() {
+		go r.postUp("Route", "AuditLog", rec)
+		return true, nil
+	}
+	js, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	err = qio.WriteAllBytes(config.Audit.File, append(js, '\n'), true)
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// onStreamComplete 数据流接收完成，按类型交给对应业务
+func (r *Route) onStreamComplete(open models.StreamOpen, file string) error {
+	switch open.Meta["Kind"] {
+	case streamKindFile:
+		return r.filesBll.OnReceived(open, file)
+	}
+	// 通用数据流保留在接收目录，由订阅通知的模块处理后自行删除
+	file, err := r.streamBll.Keep(open, file)
+	if err != nil {
+		return err
+	}
+	r.onNotice("RouteStreamDone", map[string]any{
+		"Id":     open.Id,
+		"Name":   open.Name,
+		"Source": open.Source,
+		"Size":   open.Size,
+		"Meta":   open.Meta,
+		"File":   file,
+	})
+	return nil
+}
+
+// FlushQueue 重发离线缓存
+func (r *Route) FlushQueue() {
+	r.outboxBll.Flush()
+}
+
+// GetQueueState 获取离线缓存状态
+func (r *Route) GetQueueState() (any, error) {
+	return r.outboxBll.GetState(), nil
+}
+
+func (r *Route) AddHeart(signer, id string, inst models.DeviceInstance, info map[string]models.DeviceAlarm) error {
+	if !r.isEnrolled(id) {
+		return models.NewRouteError(models.ERouteErrAccessDenied, id, "device not enrolled")
+	}
+	if signer == "" && config.Sign.Required {
+		return models.NewRouteError(models.ERouteErrAccessDenied, id, r.signBll.Reject(id, "unsigned message").Error())
+	}
+	if signer != "" && signer != id {
+		// 只能发送自己的心跳
+		return models.NewRouteError(models.ERouteErrAccessDenied, id, r.signBll.Reject(signer, "signer mismatch").Error())
+	}
+	for k, v := range info {
+		if !r.isEnrolled(k) {
+			delete(info, k)
+			continue
+		}
+		if signer != "" && !r.inSubtree(signer, k, v.FullUrl) {
+			_ = r.signBll.Reject(signer, "device out of subtree")
+			delete(info, k)
+		}
+	}
+	isChanged := r.deviceBll.AddHeart(id, inst, info)
 	if isChanged {
 		r.onNotice("RouteDeviceAlarm", qdefine.NewDateTime(time.Now()))
 	}
+	return nil
+}
+
+// inSubtree 设备是否为签名的下级路由或其下级，签名的路由只能上报自己子树中的设备，没有路径时只接受签名路由自己
+func (r *Route) inSubtree(signer, id, fullUrl string) bool {
+	if fullUrl == "" {
+		return id == signer
+	}
+	base := strings.Trim(r.deviceBll.GetFullUrl(config.DeviceId())+"/"+signer, "/")
+	return fullUrl == base || strings.HasPrefix(fullUrl, base+"/")
 }
 
-func (r *Route) GetDeviceAlarm() (any, error) {
-	return r.deviceBll.GetDeviceAlarm()
+func (r *Route) GetDeviceAlarm(filter models.DeviceFilter) (any, error) {
+	return r.deviceBll.GetDeviceAlarm(filter)
 }
 
-func (r *Route) GetDeviceList() (any, error) {
-	return r.deviceBll.GetDeviceList()
+func (r *Route) GetDeviceList(filter models.DeviceFilter) (any, error) {
+	return r.deviceBll.GetDeviceList(filter)
+}
+
+// SetDeviceName 修改目标设备的名称
+func (r *Route) SetDeviceName(info models.DeviceProfile) (any, error) {
+	if info.Device == "" || info.Name == "" {
+		return nil, errors.New("device or name is nil")
+	}
+	return r.Request(models.RouteInfo{
+		Module:  info.Device + "/Route",
+		Route:   "SetNameLocal",
+		Content: info.Name,
+	})
+}
+
+// SetDeviceDescription 修改目标设备的描述
+func (r *Route) SetDeviceDescription(info models.DeviceProfile) (any, error) {
+	if info.Device == "" {
+		return nil, errors.New("device is nil")
+	}
+	return r.Request(models.RouteInfo{
+		Module:  info.Device + "/Route",
+		Route:   "SetDescLocal",
+		Content: info.Desc,
+	})
+}
+
+// setNameLocal 保存本机的名称，并重新敲门同步到上级
+func (r *Route) setNameLocal(name string) (any, error) {
+	if err := config.SetDeviceName(name); err != nil {
+		return nil, err
+	}
+	r.deviceBll.SetLocalProfile(config.DeviceName(), config.DeviceDesc())
+	r.ReKnockDoor()
+	return true, nil
+}
+
+// setDescLocal 保存本机的描述，并重新敲门同步到上级
+func (r *Route) setDescLocal(desc string) (any, error) {
+	if err := config.SetDeviceDesc(desc); err != nil {
+		return nil, err
+	}
+	r.deviceBll.SetLocalProfile(config.DeviceName(), config.DeviceDesc())
+	r.ReKnockDoor()
+	return true, nil
+}
+
+// SetDeviceTags 编辑目标设备的标签
+func (r *Route) SetDeviceTags(info models.DeviceTags) (any, error) {
+	if info.Device == "" {
+		return nil, errors.New("device is nil")
+	}
+	return r.Request(models.RouteInfo{
+		Module:  info.Device + "/Route",
+		Route:   "SetTagsLocal",
+		Content: info.Tags,
+	})
+}
+
+// setTagsLocal 保存本机的标签，并重新敲门同步到上级
+func (r *Route) setTagsLocal(tags map[string]string) (any, error) {
+	if err := config.SetDeviceTags(tags); err != nil {
+		return nil, err
+	}
+	r.deviceBll.SetLocalTags(config.DeviceTags())
+	r.ReKnockDoor()
+	return config.DeviceTags(), nil
+}
+
+// Broadcast 向满足筛选条件的所有设备发送请求
+func (r *Route) Broadcast(req models.BroadcastRequest) (any, error) {
+	if req.Module == "" || req.Route == "" {
+		return nil, errors.New("broadcast module or route is nil")
+	}
+	list := make([]models.BroadcastResult, 0)
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, knock := range r.deviceBll.GetAllDeviceCache() {
+		if knock.FullUrl == "" || !req.Filter.Match(knock.FullUrl, knock.Tags) {
+			continue
+		}
+		wg.Add(1)
+		go func(dev string) {
+			defer wg.Done()
+			rs, err := r.Request(models.RouteInfo{
+				Module:  dev + "/" + req.Module,
+				Route:   req.Route,
+				Content: req.Content,
+			})
+			item := models.BroadcastResult{Device: dev, Result: rs}
+			if err != nil {
+				item.Error = err.Error()
+			}
+			lock.Lock()
+			list = append(list, item)
+			lock.Unlock()
+		}(knock.FullUrl)
+	}
+	wg.Wait()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Device < list[j].Device
+	})
+	return list, nil
 }
 
 func (r *Route) GetDeviceDetail() (any, error) {
-	return r.deviceBll.GetDeviceDetail()
+	return r.deviceBll.GetDeviceDetail(r.uplinkBll.State())
+}
+
+// ModuleInventory 汇总本级及下级所有设备的模块版本
+func (r *Route) ModuleInventory() ([]models.ModuleVersion, error) {
+	return r.deviceBll.GetInventory(), nil
+}
+
+// ListLogs 列出本机模块的日志文件，未指定模块时列出全部
+func (r *Route) ListLogs(module string) ([]models.LogFile, error) {
+	if module != "" {
+		return r.logsBll.List(module)
+	}
+	list, _ := r.logsBll.List("Route")
+	knock, _ := r.deviceBll.GetLocalDeviceCache()
+	for _, m := range knock.Modules {
+		if m.Name == "Route" {
+			continue
+		}
+		files, _ := r.logsBll.List(m.Name)
+		list = append(list, files...)
+	}
+	return list, nil
+}
+
+// TailLog 读取本机模块日志的最后几行
+func (r *Route) TailLog(query models.LogQuery) ([]string, error) {
+	return r.logsBll.Tail(query)
 }
 
 func (r *Route) onReq(pack easyCon.PackReq) (easyCon.EResp, any) {
@@ -162,32 +1107,81 @@ func (r *Route) onReq(pack easyCon.PackReq) (easyCon.EResp, any) {
 		_ = json.Unmarshal(js, &info)
 		rs, err := r.Request(info)
 		if err != nil {
-			return easyCon.ERespError, err.Error()
+			return easyCon.ERespError, models.ErrorContent(err)
 		}
 		return easyCon.ERespSuccess, rs
+	case "ForwardNotice":
+		// 上级路由转发下来的通知
+		r.noticeBll.Forward(qconvert.ToAny[models.NoticeForward](pack.Content), true)
+		return easyCon.ERespSuccess, true
+	case "SetNoticeInterest":
+		// 上级路由推送的订阅
+		r.noticeBll.SetUpper(qconvert.ToAny[[]string](pack.Content))
+		return easyCon.ERespSuccess, true
 	}
-	return easyCon.ERespRouteNotFind, "Route Not Matched"
+	return easyCon.ERespRouteNotFind, models.NewRouteError(models.ERouteErrNotFound, config.DeviceId(), "Route Not Matched").Json()
 }
 
-func (r *Route) upRequestFunc(module, route string, content any) (any, error) {
-	if r.upperAdapter != nil {
-		resp := r.upperAdapter.Req(module, route, content)
-		if resp.RespCode == easyCon.ERespSuccess {
-			return resp.Content, nil
-		}
-		if resp.Error != "" {
-			return nil, errors.New(resp.Error)
+// isRoot 是否为根路由，即没有配置上级Broker的服务路由
+func (r *Route) isRoot() bool {
+	return config.Mode.IsServer() && !r.uplinkBll.Configured()
+}
+
+// upAdapter 获取向上的访问器，客户端为本地Broker，服务端为上层Broker，根路由为空
+func (r *Route) upAdapter() easyCon.IAdapter {
+	if config.Mode.IsClient() {
+		return r.localAdapter
+	}
+	return r.uplinkBll.Adapter()
+}
+
+// 向上级发送时需要签名的路由
+var signedRoutes = map[string]bool{"Heart": true, "KnockDoor": true, "AuditLog": true}
+
+// upSend 向上级发送请求，开启签名时在发送前签名，离线缓存补发时也是新的签名
+func (r *Route) upSend(module, route string, content any) easyCon.PackResp {
+	adapter := r.upAdapter()
+	if adapter == nil {
+		return easyCon.PackResp{RespCode: easyCon.ERespUnLinked}
+	}
+	if config.Sign.Enabled && module == "Route" && signedRoutes[route] {
+		msg, err := config.SignMessage(route, content)
+		if err != nil {
+			return easyCon.PackResp{RespCode: easyCon.ERespError, Error: err.Error()}
 		}
-		return nil, errors.New(fmt.Sprintf("%d", resp.RespCode))
+		content = msg
 	}
-	resp := r.localAdapter.Req(module, route, content)
-	if resp.RespCode == easyCon.ERespSuccess {
-		return resp.Content, nil
+	return adapter.Req(module, route, content)
+}
+
+// postUp 向上级发送不需要结果的请求，已有缓存或连接故障时写入离线缓存，保证顺序
+func (r *Route) postUp(module, route string, content any) {
+	if r.isRoot() {
+		return
+	}
+	if r.outboxBll.Count() > 0 {
+		r.outboxBll.Add(module, route, content)
+		go r.outboxBll.Flush()
+		return
+	}
+	resp := r.upSend(module, route, content)
+	if isLinkFault(resp.RespCode) {
+		r.outboxBll.Add(module, route, content)
+	}
+}
+
+func (r *Route) upRequestFunc(module, route string, content any) (any, error) {
+	upperId := r.deviceBll.GetUpperId()
+	if r.uplinkBll.Configured() {
+		resp := r.upSend(module, route, content)
+		return respResult(resp, upperId)
 	}
-	if resp.Error != "" {
-		return nil, errors.New(resp.Error)
+	if config.Mode.IsServer() {
+		// 根路由没有上级
+		return nil, models.NewRouteError(models.ERouteErrUpstream, config.DeviceId(), "upper route is not configured")
 	}
-	return nil, errors.New(fmt.Sprintf("%d", resp.RespCode))
+	resp := r.localAdapter.Req(module, route, content)
+	return respResult(resp, upperId)
 }
 
 func (r *Route) routeRequest(info models.RouteInfo) (any, error) {
@@ -195,6 +1189,9 @@ func (r *Route) routeRequest(info models.RouteInfo) (any, error) {
 	newParams["Module"] = info.Module
 	newParams["Route"] = info.Route
 	newParams["Content"] = info.Content
+	newParams["Trace"] = info.Trace
+	newParams["Queue"] = info.Queue
+	newParams["Origin"] = info.Origin
 
 	// 拆分路由
 	sp := strings.Split(info.Module, "/")
@@ -213,6 +1210,10 @@ func (r *Route) routeRequest(info models.RouteInfo) (any, error) {
 		}
 		// 已经是最底层路由
 		if strings.Contains(newModule, "/") == false {
+			// 本机路由只能经路由请求到达，在本进程内处理
+			if newModule == "Route" && localRoutes[info.Route] {
+				return r.requestLocal(info)
+			}
 			// 如果是客户端，则补上ID，反之去掉
 			if newModule == "Route" {
 				if config.Mode.IsClient() {
@@ -222,26 +1223,25 @@ func (r *Route) routeRequest(info models.RouteInfo) (any, error) {
 				newModule = fmt.Sprintf("%s.%s", newModule, devCode)
 			}
 			resp := r.localAdapter.Req(newModule, info.Route, info.Content)
-			if resp.RespCode == easyCon.ERespSuccess {
-				return resp.Content, nil
-			}
-			if resp.Error != "" {
-				return nil, errors.New(resp.Error)
-			}
-			return nil, errors.New(fmt.Sprintf("%d", resp.RespCode))
+			return respResult(resp, devCode)
 		}
 		// 未到底层，继续向下级路由请求
 		newParams["Module"] = newModule
 		// 截取下级设备码
 		sp = strings.Split(newModule, "/")
-		resp := r.localAdapter.Req(fmt.Sprintf("Route.%s", sp[0]), "Request", newParams)
-		if resp.RespCode == easyCon.ERespSuccess {
-			return resp.Content, nil
-		}
-		if resp.Error != "" {
-			return nil, errors.New(resp.Error)
+		// 下级设备离线或未登记时直接返回，不再等待超时
+		if err := r.checkRoutePath(sp); err != nil {
+			if info.Queue && err.Code == models.ERouteErrDeviceOffline && err.DeviceId == sp[0] {
+				// 直接下级离线，排队等待上线后投递
+				return r.pendingBll.Add(sp[0], info)
+			}
+			if !info.Queue || err.DeviceId == sp[0] {
+				return nil, err
+			}
+			// 更下级的设备离线，交由其直接上级路由排队
 		}
-		return nil, errors.New(fmt.Sprintf("%d", resp.RespCode))
+		resp := r.localAdapter.Req(fmt.Sprintf("Route.%s", sp[0]), "Request", newParams)
+		return respResult(resp, sp[0])
 	} else {
 		// 向上机路由请求
 		rs, err := r.upRequestFunc("Route", "Request", newParams)
@@ -252,29 +1252,218 @@ func (r *Route) routeRequest(info models.RouteInfo) (any, error) {
 	}
 }
 
+// 只能经路由请求到达的本机路由，不在总线上开放
+var localRoutes = map[string]bool{
+	"ExecLocal":        true,
+	"ControlLocal":     true,
+	"UpdateLocal":      true,
+	"RollbackLocal":    true,
+	"ReprovisionLocal": true,
+	"SetNameLocal":     true,
+	"SetDescLocal":     true,
+	"SetTagsLocal":     true,
+}
+
+// requestLocal 处理本机路由，请求方使用路由填写的来源，忽略内容中自带的
+func (r *Route) requestLocal(info models.RouteInfo) (any, error) {
+	switch info.Route {
+	case "ExecLocal": // 在本机执行命令
+		req, err := qconvert.ToAnyError[models.ExecRequest](info.Content)
+		if err != nil {
+			return nil, err
+		}
+		req.From = info.Origin
+		return r.execLocal(req)
+	case "ControlLocal": // 控制本机模块
+		req, err := qconvert.ToAnyError[models.ModuleControl](info.Content)
+		if err != nil {
+			return nil, err
+		}
+		req.From = info.Origin
+		return r.controlLocal(req)
+	case "UpdateLocal": // 更新本机模块
+		req, err := qconvert.ToAnyError[models.UpdateRequest](info.Content)
+		if err != nil {
+			return nil, err
+		}
+		req.From = info.Origin
+		return r.updateLocal(req)
+	case "RollbackLocal": // 回滚本机模块
+		req, err := qconvert.ToAnyError[models.UpdateRequest](info.Content)
+		if err != nil {
+			return nil, err
+		}
+		req.From = info.Origin
+		return r.rollbackLocal(req)
+	case "ReprovisionLocal": // 重新申请本机的设备码
+		req, err := qconvert.ToAnyError[models.Reprovision](info.Content)
+		if err != nil {
+			return nil, err
+		}
+		return r.reprovisionLocal(req)
+	case "SetNameLocal": // 保存本机的名称
+		name, err := qconvert.ToAnyError[string](info.Content)
+		if err != nil {
+			return nil, err
+		}
+		return r.setNameLocal(name)
+	case "SetDescLocal": // 保存本机的描述
+		desc, err := qconvert.ToAnyError[string](info.Content)
+		if err != nil {
+			return nil, err
+		}
+		return r.setDescLocal(desc)
+	case "SetTagsLocal": // 保存本机的标签
+		tags, err := qconvert.ToAnyError[map[string]string](info.Content)
+		if err != nil {
+			return nil, err
+		}
+		return r.setTagsLocal(tags)
+	}
+	return nil, models.NewRouteError(models.ERouteErrNotFound, config.DeviceId(), "route Not Matched")
+}
+
+// checkRoutePath 检查下级路径上的设备，sp为去掉本级后的路径（最后一项为模块名称）
+// 直接下级未知时，仅在启动后的一个心跳周期内继续转发；更下级的设备只检查已知的是否离线，未知的交给下级路由判断
+func (r *Route) checkRoutePath(sp []string) *models.RouteError {
+	devs := []string{sp[0]}
+	if len(sp) > 2 {
+		devs = append(devs, sp[len(sp)-2])
+	}
+	for i, devId := range devs {
+		known, offline, since := r.deviceBll.CheckDevice(devId)
+		if !known {
+			if i > 0 || time.Since(r.started) < heartTimeout*time.Second {
+				continue
+			}
+			return models.NewRouteError(models.ERouteErrDeviceUnknown, devId, "device unknown")
+		}
+		if offline {
+			msg := "device offline"
+			if !since.IsZero() {
+				msg = fmt.Sprintf("device offline since %s", since.Format("2006-01-02 15:04:05"))
+			}
+			return models.NewRouteError(models.ERouteErrDeviceOffline, devId, msg)
+		}
+	}
+	return nil
+}
+
+// onDeviceOnline 设备恢复在线，按顺序投递排队的请求
+func (r *Route) onDeviceOnline(devId string) {
+	for _, info := range r.pendingBll.Take(devId) {
+		_, _ = r.routeRequest(info)
+	}
+}
+
+// respResult 解析响应结果，失败时转为路由错误，devId为请求目标所在的设备
+func respResult(resp easyCon.PackResp, devId string) (any, error) {
+	switch resp.RespCode {
+	case easyCon.ERespSuccess:
+		return resp.Content, nil
+	case easyCon.ERespUnLinked:
+		return nil, models.NewRouteError(models.ERouteErrUpstream, devId, "broker is not linked")
+	case easyCon.ERespTimeout:
+		return nil, models.NewRouteError(models.ERouteErrTimeout, devId, "request timeout")
+	case easyCon.ERespRouteNotFind:
+		return nil, models.NewRouteError(models.ERouteErrNotFound, devId, "request route not find")
+	case easyCon.ERespForbidden:
+		return nil, models.NewRouteError(models.ERouteErrAccessDenied, devId, "request forbidden")
+	}
+	if resp.Content == nil && resp.Error == "" {
+		return nil, models.NewRouteError(models.ERouteErrRemote, devId, fmt.Sprintf("response code %d", resp.RespCode))
+	}
+	// 下级返回的路由错误保留原始的失败设备
+	err := models.ParseRouteError(resp.Content, resp.Error)
+	if err.DeviceId == "" {
+		err.DeviceId = devId
+	}
+	return nil, err
+}
+
 func (r *Route) heartLoop() {
+	host, _ := os.Hostname()
+	inst := models.DeviceInstance{
+		Instance: config.InstanceId(),
+		Hostname: host,
+	}
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
+			inst.FullUrl = r.deviceBll.GetFullUrl(config.DeviceId())
 			// 向上级路由模块发送请求
 			alarms := map[string]any{
-				"Id":   config.DeviceId(),
-				"Info": r.deviceBll.GetAlarmCaches(),
+				"Id":       config.DeviceId(),
+				"Instance": inst,
+				"Info":     r.deviceBll.GetAlarmCaches(),
 			}
-			if config.Mode.IsClient() {
-				go r.localAdapter.Req("Route", "Heart", alarms)
-			} else {
-				if r.upperAdapter != nil {
-					go r.upperAdapter.Req("Route", "Heart", alarms)
+			js, _ := json.Marshal(alarms)
+			changed := string(js) != r.lastHeart
+			if changed {
+				r.lastHeart = string(js)
+			}
+			// 上级断开时只缓存有变化的心跳，恢复后按顺序补发，没有变化的不发送
+			if r.upAdapter() == nil || (r.uplinkBll.Configured() && !r.uplinkBll.Linked()) {
+				if changed {
+					r.postUp("Route", "Heart", json.RawMessage(js))
 				}
+				continue
 			}
+			// 报警有变化时走离线缓存，保证断线期间的变化按顺序补发
+			if changed {
+				go r.postUp("Route", "Heart", json.RawMessage(js))
+			} else if r.outboxBll.Count() > 0 {
+				go r.outboxBll.Flush()
+			} else {
+				go r.upSend("Route", "Heart", json.RawMessage(js))
+			}
+		}
+	}
+}
+
+func (r *Route) certLoop() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	last := ""
+	for {
+		if alarm := config.UpCertAlarm(); alarm != last {
+			last = alarm
+			r.deviceBll.SetAlarm("CertExpiry", alarm)
 		}
+		<-ticker.C
 	}
 }
 
 func (r *Route) onStatus(adapter easyCon.IAdapter, status easyCon.EStatus) {
+	// 构造时访问器可能早于uplinkBll赋值，由健康检查补上状态
+	if r.uplinkBll != nil {
+		r.uplinkBll.OnStatus(adapter, status)
+	}
+}
+
+// uplinkAlarmLoop 上级断开超过配置的时间后报警
+func (r *Route) uplinkAlarmLoop() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 
+	last := ""
+	for range ticker.C {
+		alarm := ""
+		if down := r.uplinkBll.DownFor(); down > time.Duration(config.Failover.DownAlarm)*time.Second {
+			st := r.uplinkBll.State()
+			alarm = fmt.Sprintf("%s down for %ds", st.Addr, int(down.Seconds()))
+			if st.Addr == "" {
+				alarm = fmt.Sprintf("no upper broker for %ds", int(down.Seconds()))
+			}
+		}
+		// 只在报警出现和消失时更新，避免持续时间变化导致频繁上报
+		if (alarm == "") != (last == "") {
+			r.deviceBll.SetAlarm("UplinkDown", alarm)
+		}
+		last = alarm
+	}
 }
@@ -0,0 +1,193 @@
+package blls
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kamioair/qf/utils/qio"
+	"router/inner/config"
+	"router/inner/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 验签失败报警的保留时间
+const signFailureKeep = 10 * time.Minute
+
+type signFailure struct {
+	reason string
+	time   time.Time
+}
+
+type signature struct {
+	lock     *sync.Mutex
+	keys     map[string]string      // 根路由登记的设备公钥，key为设备码
+	cache    map[string]string      // 非根路由从上级获取的设备公钥
+	nonces   map[string]time.Time   // 已使用的随机数，超过时间偏差后清除
+	failures map[string]signFailure // 最近的验签失败，key为设备码
+	isRoot   func() bool
+	fetchKey func(devId string) string // 向上级获取设备公钥
+}
+
+func newSignatureBll(isRoot func() bool, fetchKey func(devId string) string) *signature {
+	s := &signature{
+		lock:     &sync.Mutex{},
+		keys:     map[string]string{},
+		cache:    map[string]string{},
+		nonces:   map[string]time.Time{},
+		failures: map[string]signFailure{},
+		isRoot:   isRoot,
+		fetchKey: fetchKey,
+	}
+	s.load()
+	return s
+}
+
+// Verify 校验签名、时间和随机数，返回消息内容
+func (s *signature) Verify(route string, msg models.SignedMessage) ([]byte, error) {
+	if msg.Route != route || msg.Id == "" {
+		return nil, s.fail(msg.Id, "route mismatch")
+	}
+	skew := time.Duration(config.Sign.MaxSkew) * time.Second
+	at := time.UnixMilli(msg.Time)
+	if at.Before(time.Now().Add(-skew)) || at.After(time.Now().Add(skew)) {
+		return nil, s.fail(msg.Id, "timestamp out of range")
+	}
+	pub, err := base64.StdEncoding.DecodeString(s.GetKey(msg.Id))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, s.fail(msg.Id, "public key not registered")
+	}
+	sig, err := base64.StdEncoding.DecodeString(msg.Sig)
+	if err != nil || !ed25519.Verify(pub, msg.Payload(), sig) {
+		return nil, s.fail(msg.Id, "bad signature")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k, t := range s.nonces {
+		if time.Since(t) > skew {
+			delete(s.nonces, k)
+		}
+	}
+	nonce := msg.Id + "/" + msg.Nonce
+	if _, ok := s.nonces[nonce]; ok {
+		s.failures[msg.Id] = signFailure{reason: "replayed nonce", time: time.Now()}
+		return nil, errors.New("replayed nonce")
+	}
+	s.nonces[nonce] = at
+	return []byte(msg.Body), nil
+}
+
+// Reject 记录被拒绝的消息，用于报警
+func (s *signature) Reject(devId, reason string) error {
+	return s.fail(devId, reason)
+}
+
+// Register 登记设备公钥，仅根路由
+func (s *signature) Register(devId, pub string) {
+	if devId == "" || pub == "" {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.keys[devId] == pub {
+		return
+	}
+	s.keys[devId] = pub
+	s.save()
+}
+
+// Unregister 移除设备公钥，仅根路由
+func (s *signature) Unregister(devId string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.keys[devId]; !ok {
+		return false
+	}
+	delete(s.keys, devId)
+	s.save()
+	return true
+}
+
+// GetKey 获取设备公钥，根路由从登记中获取，其他路由向上级获取后缓存
+func (s *signature) GetKey(devId string) string {
+	s.lock.Lock()
+	if s.isRoot() {
+		defer s.lock.Unlock()
+		return s.keys[devId]
+	}
+	pub, ok := s.cache[devId]
+	s.lock.Unlock()
+	if ok {
+		return pub
+	}
+
+	pub = s.fetchKey(devId)
+	if pub != "" {
+		s.lock.Lock()
+		s.cache[devId] = pub
+		s.lock.Unlock()
+	}
+	return pub
+}
+
+// Forget 清除缓存的设备公钥，设备更换公钥后重新获取
+func (s *signature) Forget(devId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.cache, devId)
+}
+
+// Alarm 最近的验签失败报警内容
+func (s *signature) Alarm() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lines := make([]string, 0)
+	for id, f := range s.failures {
+		if time.Since(f.time) > signFailureKeep {
+			delete(s.failures, id)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", id, f.reason))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func (s *signature) fail(devId, reason string) error {
+	if devId == "" {
+		devId = "unknown"
+	}
+	s.lock.Lock()
+	s.failures[devId] = signFailure{reason: reason, time: time.Now()}
+	s.lock.Unlock()
+
+	// 公钥可能已更换，下次重新获取
+	s.Forget(devId)
+	return errors.New(reason)
+}
+
+func (s *signature) load() {
+	str, err := qio.ReadAllBytes(config.Sign.File)
+	if err != nil {
+		return
+	}
+	_ = json.Unmarshal(str, &s.keys)
+}
+
+func (s *signature) save() {
+	js, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return
+	}
+	_ = qio.WriteAllBytes(config.Sign.File, js, false)
+}
@@ -0,0 +1,111 @@
+package blls
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"router/inner/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSignature(t *testing.T) (*signature, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &signature{
+		lock:     &sync.Mutex{},
+		keys:     map[string]string{"dev1": base64.StdEncoding.EncodeToString(pub)},
+		cache:    map[string]string{},
+		nonces:   map[string]time.Time{},
+		failures: map[string]signFailure{},
+		isRoot:   func() bool { return true },
+	}
+	return s, priv
+}
+
+func signTest(priv ed25519.PrivateKey, msg models.SignedMessage) models.SignedMessage {
+	msg.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, msg.Payload()))
+	return msg
+}
+
+func TestSignatureVerify(t *testing.T) {
+	s, priv := newTestSignature(t)
+	_, other, _ := ed25519.GenerateKey(nil)
+	now := time.Now().UnixMilli()
+	msg := func(id, route string, at int64, nonce string) models.SignedMessage {
+		return models.SignedMessage{Id: id, Route: route, Time: at, Nonce: nonce, Body: `{"a":1}`}
+	}
+	tampered := signTest(priv, msg("dev1", "Heart", now, "n6"))
+	tampered.Body = `{"a":2}`
+
+	tests := []struct {
+		name    string
+		route   string
+		msg     models.SignedMessage
+		wantErr bool
+	}{
+		{"valid", "Heart", signTest(priv, msg("dev1", "Heart", now, "n1")), false},
+		{"replayed nonce", "Heart", signTest(priv, msg("dev1", "Heart", now, "n1")), true},
+		{"route mismatch", "KnockDoor", signTest(priv, msg("dev1", "Heart", now, "n2")), true},
+		{"too old", "Heart", signTest(priv, msg("dev1", "Heart", now-int64(time.Hour/time.Millisecond), "n3")), true},
+		{"unregistered", "Heart", signTest(priv, msg("dev2", "Heart", now, "n4")), true},
+		{"other key", "Heart", signTest(other, msg("dev1", "Heart", now, "n5")), true},
+		{"tampered body", "Heart", tampered, true},
+		{"no signature", "Heart", msg("dev1", "Heart", now, "n7"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := s.Verify(tt.route, tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(body) != tt.msg.Body {
+				t.Errorf("Verify() body = %s, want %s", body, tt.msg.Body)
+			}
+		})
+	}
+}
+
+func TestUnseal(t *testing.T) {
+	s, priv := newTestSignature(t)
+	r := &Route{signBll: s}
+	now := time.Now().UnixMilli()
+	heart := `{"Id":"dev1","Info":{}}`
+	raw := func(v any) any {
+		js, _ := json.Marshal(v)
+		var out any
+		_ = json.Unmarshal(js, &out)
+		return out
+	}
+	nonceOnly := models.SignedMessage{Id: "dev1", Route: "Heart", Time: now, Nonce: "n2", Body: heart}
+
+	tests := []struct {
+		name       string
+		content    any
+		wantSigner string
+		wantErr    bool
+	}{
+		{"unsigned", raw(map[string]any{"Id": "dev1", "Info": map[string]any{}}), "", false},
+		{"signed", raw(signTest(priv, models.SignedMessage{Id: "dev1", Route: "Heart", Time: now, Nonce: "n1", Body: heart})), "dev1", false},
+		{"nonce without signature", raw(nonceOnly), "", true},
+		{"bad signature", raw(signTest(priv, models.SignedMessage{Id: "dev2", Route: "Heart", Time: now, Nonce: "n3", Body: heart})), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := map[string]any{}
+			signer, err := r.Unseal("Heart", tt.content, &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unseal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if signer != tt.wantSigner {
+				t.Errorf("Unseal() signer = %q, want %q", signer, tt.wantSigner)
+			}
+			if !tt.wantErr && out["Id"] != "dev1" {
+				t.Errorf("Unseal() content = %v", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,654 @@
+package blls
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kamioair/qf/qdefine"
+	"github.com/kamioair/qf/utils/qconvert"
+	"github.com/kamioair/qf/utils/qio"
+	"github.com/shirou/gopsutil/v4/disk"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"router/inner/config"
+	"router/inner/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var streamIdReg = regexp.MustCompile(`^[A-Za-z0-9\-]+$`)
+
+const (
+	streamMaxChunk     = 16 * 1024 * 1024 // 单个数据块的最大大小
+	streamSaveInterval = 2 * time.Second  // 接收状态的保存间隔，重启后未保存的块由发送方重发
+)
+
+// recvState 接收方的流状态，保存到文件用于续传
+type recvState struct {
+	Open     models.StreamOpen
+	Received []bool
+	Time     qdefine.DateTime
+	lock     *sync.Mutex // 单个流的锁，写入文件时不影响其他流
+	file     *os.File    // 接收中的临时文件
+	saved    time.Time   // 最后一次保存状态的时间
+}
+
+type stream struct {
+	lock       *sync.Mutex
+	deviceBll  *device
+	request    func(info models.RouteInfo) (any, error)
+	onComplete func(open models.StreamOpen, file string) error // 接收完成，file为校验后的临时文件
+	recvs      map[string]*recvState
+	sends      map[string]*models.StreamState
+	finished   map[string]*models.StreamState // 已结束的接收，用于拉取方查询进度
+}
+
+func newStreamBll(deviceBll *device, request func(info models.RouteInfo) (any, error), onComplete func(open models.StreamOpen, file string) error) *stream {
+	return &stream{
+		lock:       &sync.Mutex{},
+		deviceBll:  deviceBll,
+		request:    request,
+		onComplete: onComplete,
+		recvs:      map[string]*recvState{},
+		sends:      map[string]*models.StreamState{},
+		finished:   map[string]*models.StreamState{},
+	}
+}
+
+// Start 启动定时清理
+func (s *stream) Start() {
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.cleanup()
+		}
+	}()
+}
+
+//-------------------------------------------
+//  发送方
+
+// Send 向目标设备发送文件，target为目标设备路径，异步执行
+func (s *stream) Send(target string, file string, name string, meta map[string]string) (models.StreamState, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return models.StreamState{}, err
+	}
+	if stat.IsDir() {
+		return models.StreamState{}, errors.New("stream source is a directory")
+	}
+	chunkSize := config.Stream.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 256 * 1024
+	}
+	open := models.StreamOpen{
+		Id:        uuid.NewString(),
+		Name:      name,
+		Size:      stat.Size(),
+		ChunkSize: chunkSize,
+		Source:    s.deviceBll.GetFullUrl(config.DeviceId()),
+		Meta:      meta,
+	}
+	st := &models.StreamState{
+		Id:     open.Id,
+		Name:   name,
+		Peer:   target,
+		IsSend: true,
+		Size:   open.Size,
+		Status: "Running",
+		Time:   qdefine.NewDateTime(time.Now()),
+	}
+	s.lock.Lock()
+	s.sends[st.Id] = st
+	s.lock.Unlock()
+
+	go s.send(st, target, file, open)
+	return *st, nil
+}
+
+// GetState 获取发送状态
+func (s *stream) GetState(id string) (models.StreamState, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.sends[id]
+	if !ok {
+		return models.StreamState{}, false
+	}
+	return *st, true
+}
+
+// Wait 等待发送结束
+func (s *stream) Wait(id string) models.StreamState {
+	for {
+		state, ok := s.GetState(id)
+		if !ok || state.Status == "Done" || state.Status == "Failed" {
+			return state
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (s *stream) send(st *models.StreamState, target, file string, open models.StreamOpen) {
+	sum, err := fileSha256(file)
+	if err != nil {
+		s.setSendState(st, "Failed", 0, err)
+		return
+	}
+
+	// 断线等可恢复的错误，按退避时间重新打开续传
+	deadline := time.Now().Add(time.Duration(config.Stream.RetryTimeout) * time.Second)
+	delay := time.Second
+	for {
+		err = s.sendOnce(st, target, file, open, sum)
+		if err == nil {
+			s.setSendState(st, "Done", open.Size, nil)
+			return
+		}
+		if !isRetryable(err) || time.Now().After(deadline) {
+			s.setSendState(st, "Failed", -1, err)
+			return
+		}
+		s.setSendState(st, "Retrying", -1, err)
+		time.Sleep(delay)
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+func (s *stream) sendOnce(st *models.StreamState, target, file string, open models.StreamOpen, sum string) error {
+	module := target + "/Route"
+
+	// 打开，获取续传位置
+	rs, err := s.request(models.RouteInfo{Module: module, Route: "StreamOpen", Content: open})
+	if err != nil {
+		return err
+	}
+	ack := qconvert.ToAny[models.StreamAck](rs)
+	s.setSendState(st, "Running", int64(ack.Next)*int64(open.ChunkSize), nil)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// 按窗口并发发送
+	total := chunkCount(open.Size, open.ChunkSize)
+	window := config.Stream.Window
+	if window <= 0 {
+		window = 1
+	}
+	sem := make(chan struct{}, window)
+	wg := &sync.WaitGroup{}
+	errLock := &sync.Mutex{}
+	var firstErr error
+	for seq := ack.Next; seq < total; seq++ {
+		errLock.Lock()
+		failed := firstErr != nil
+		errLock.Unlock()
+		if failed {
+			break
+		}
+
+		buf := make([]byte, open.ChunkSize)
+		n, err := f.ReadAt(buf, int64(seq)*int64(open.ChunkSize))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		chunk := models.StreamChunk{Id: open.Id, Seq: seq, Data: buf[:n], Crc: crc32.ChecksumIEEE(buf[:n])}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			_, err := s.request(models.RouteInfo{Module: module, Route: "StreamChunk", Content: chunk})
+			if err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errLock.Unlock()
+				return
+			}
+			s.addSendBytes(st, int64(len(chunk.Data)))
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	// 关闭并校验
+	_, err = s.request(models.RouteInfo{Module: module, Route: "StreamClose", Content: models.StreamClose{Id: open.Id, Sha256: sum}})
+	return err
+}
+
+// setSendState 更新发送状态，transferred小于0表示不变
+func (s *stream) setSendState(st *models.StreamState, status string, transferred int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st.Status = status
+	if transferred >= 0 {
+		st.Transferred = transferred
+	}
+	st.Error = ""
+	if err != nil {
+		st.Error = err.Error()
+	}
+	st.Time = qdefine.NewDateTime(time.Now())
+}
+
+// addSendBytes 增加已发送大小
+func (s *stream) addSendBytes(st *models.StreamState, size int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st.Transferred += size
+	if st.Transferred > st.Size {
+		st.Transferred = st.Size
+	}
+	st.Time = qdefine.NewDateTime(time.Now())
+}
+
+//-------------------------------------------
+//  接收方
+
+// Open 打开或续传
+func (s *stream) Open(open models.StreamOpen) (models.StreamAck, error) {
+	if !streamIdReg.MatchString(open.Id) || open.ChunkSize <= 0 || open.ChunkSize > streamMaxChunk || open.Size < 0 {
+		return models.StreamAck{}, errors.New("stream open args is invalid")
+	}
+	if config.Stream.MaxSize > 0 && open.Size > config.Stream.MaxSize {
+		return models.StreamAck{}, errors.New(fmt.Sprintf("stream size %d exceeds the limit %d", open.Size, config.Stream.MaxSize))
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := s.loadRecv(open.Id)
+	if state == nil || state.Open.Size != open.Size || state.Open.ChunkSize != open.ChunkSize {
+		// 新的流
+		if state != nil {
+			state.lock.Lock()
+			state.closeFile()
+			state.lock.Unlock()
+		}
+		// 按接收目录所在磁盘的可用空间限制大小
+		free, err := diskFree(qio.GetFullPath(config.Stream.Dir))
+		if err != nil {
+			return models.StreamAck{}, err
+		}
+		if open.Size > free {
+			return models.StreamAck{}, errors.New(fmt.Sprintf("stream size %d exceeds the free disk space %d", open.Size, free))
+		}
+		state = &recvState{
+			Open:     open,
+			Received: make([]bool, chunkCount(open.Size, open.ChunkSize)),
+			lock:     &sync.Mutex{},
+		}
+		if err := qio.CreateFile(s.recvFile(open.Id, ".part")); err != nil {
+			return models.StreamAck{}, err
+		}
+		if err := os.Truncate(s.recvFile(open.Id, ".part"), open.Size); err != nil {
+			return models.StreamAck{}, err
+		}
+		s.recvs[open.Id] = state
+		s.saveRecv(state)
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return models.StreamAck{Id: open.Id, Next: nextMissing(state.Received)}, nil
+}
+
+// Chunk 写入数据块，只锁定当前流，状态按间隔保存
+func (s *stream) Chunk(chunk models.StreamChunk) (models.StreamAck, error) {
+	s.lock.Lock()
+	state := s.loadRecv(chunk.Id)
+	s.lock.Unlock()
+	if state == nil {
+		return models.StreamAck{}, errors.New(fmt.Sprintf("stream %s is not opened", chunk.Id))
+	}
+
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	if chunk.Seq < 0 || chunk.Seq >= len(state.Received) {
+		return models.StreamAck{}, errors.New(fmt.Sprintf("stream chunk %d out of range", chunk.Seq))
+	}
+	if crc32.ChecksumIEEE(chunk.Data) != chunk.Crc {
+		return models.StreamAck{}, errors.New(fmt.Sprintf("stream chunk %d checksum error", chunk.Seq))
+	}
+	offset := int64(chunk.Seq) * int64(state.Open.ChunkSize)
+	if offset+int64(len(chunk.Data)) > state.Open.Size {
+		return models.StreamAck{}, errors.New(fmt.Sprintf("stream chunk %d size error", chunk.Seq))
+	}
+
+	if !state.Received[chunk.Seq] {
+		if state.file == nil {
+			f, err := os.OpenFile(s.recvFile(chunk.Id, ".part"), os.O_WRONLY, 0644)
+			if err != nil {
+				return models.StreamAck{}, err
+			}
+			state.file = f
+		}
+		if _, err := state.file.WriteAt(chunk.Data, offset); err != nil {
+			return models.StreamAck{}, err
+		}
+		state.Received[chunk.Seq] = true
+		if time.Since(state.saved) >= streamSaveInterval {
+			s.saveRecv(state)
+		}
+	}
+	return models.StreamAck{Id: chunk.Id, Next: nextMissing(state.Received)}, nil
+}
+
+// Close 校验并完成接收
+func (s *stream) Close(c models.StreamClose) (any, error) {
+	s.lock.Lock()
+	state := s.loadRecv(c.Id)
+	s.lock.Unlock()
+	if state == nil {
+		return nil, errors.New(fmt.Sprintf("stream %s is not opened", c.Id))
+	}
+
+	state.lock.Lock()
+	if next := nextMissing(state.Received); next < len(state.Received) {
+		state.lock.Unlock()
+		return nil, errors.New(fmt.Sprintf("stream chunk %d is missing", next))
+	}
+	state.closeFile()
+	state.lock.Unlock()
+
+	part := s.recvFile(c.Id, ".part")
+	sum, err := fileSha256(part)
+	if err == nil && sum != c.Sha256 {
+		err = errors.New("stream sha256 mismatch")
+	}
+	s.lock.Lock()
+	if s.recvs[c.Id] != state {
+		// 校验期间已被重新打开或关闭
+		s.lock.Unlock()
+		return nil, errors.New(fmt.Sprintf("stream %s is not opened", c.Id))
+	}
+	if err != nil {
+		// 内容错误，丢弃后由发送方重新发送
+		s.removeRecv(c.Id)
+		s.setFinished(state, err)
+		s.lock.Unlock()
+		return nil, err
+	}
+	delete(s.recvs, c.Id)
+	_ = os.Remove(s.recvFile(c.Id, ".json"))
+	s.lock.Unlock()
+
+	// 交给上层业务处理
+	if s.onComplete != nil {
+		err = s.onComplete(state.Open, part)
+	}
+	_ = os.Remove(part)
+	s.lock.Lock()
+	s.setFinished(state, err)
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// Keep 将接收完成的临时文件移到接收目录保留，由订阅RouteStreamDone的模块处理，返回保存的文件
+func (s *stream) Keep(open models.StreamOpen, part string) (string, error) {
+	name := filepath.Base(strings.ReplaceAll(open.Name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		name = "data"
+	}
+	file := filepath.Join(qio.GetFullPath(config.Stream.Dir), "received", open.Id+"_"+name)
+	if _, err := qio.CreateDirectory(filepath.Dir(file)); err != nil {
+		return "", err
+	}
+	if err := os.Rename(part, file); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// RecvState 获取接收状态，包括已结束的接收
+func (s *stream) RecvState(id string) (models.StreamState, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if st, ok := s.finished[id]; ok {
+		return *st, true
+	}
+	if r, ok := s.recvs[id]; ok {
+		return r.state(), true
+	}
+	return models.StreamState{}, false
+}
+
+// setFinished 记录接收结束，调用方需持有锁
+func (s *stream) setFinished(state *recvState, err error) {
+	st := &models.StreamState{
+		Id:          state.Open.Id,
+		Name:        state.Open.Name,
+		Peer:        state.Open.Source,
+		Size:        state.Open.Size,
+		Transferred: state.Open.Size,
+		Status:      "Done",
+		Time:        qdefine.NewDateTime(time.Now()),
+	}
+	if err != nil {
+		st.Status = "Failed"
+		st.Error = err.Error()
+	}
+	s.finished[st.Id] = st
+}
+
+// cleanup 清理已结束超过1小时的状态，以及超过续传时间仍未完成的接收
+func (s *stream) cleanup() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	expire := time.Now().Add(-time.Hour)
+	for id, st := range s.sends {
+		if (st.Status == "Done" || st.Status == "Failed") && st.Time.ToTime().Before(expire) {
+			delete(s.sends, id)
+		}
+	}
+	for id, st := range s.finished {
+		if st.Time.ToTime().Before(expire) {
+			delete(s.finished, id)
+		}
+	}
+
+	// 发送方放弃续传后，接收缓存不会再被使用
+	abandon := expire.Add(-time.Duration(config.Stream.RetryTimeout) * time.Second)
+	for id, r := range s.recvs {
+		r.lock.Lock()
+		old := r.Time.ToTime().Before(abandon)
+		r.lock.Unlock()
+		if old {
+			s.removeRecv(id)
+		}
+	}
+	entries, err := os.ReadDir(qio.GetFullPath(config.Stream.Dir))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		id := strings.TrimSuffix(e.Name(), ext)
+		if _, ok := s.recvs[id]; ok || (ext != ".part" && ext != ".json") {
+			continue
+		}
+		if info, err := e.Info(); err == nil && info.ModTime().Before(abandon) {
+			_ = os.Remove(filepath.Join(qio.GetFullPath(config.Stream.Dir), e.Name()))
+		}
+	}
+}
+
+// GetStreams 获取所有流的状态
+func (s *stream) GetStreams() []models.StreamState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list := make([]models.StreamState, 0)
+	for _, st := range s.sends {
+		list = append(list, *st)
+	}
+	for _, r := range s.recvs {
+		list = append(list, r.state())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time > list[j].Time
+	})
+	return list
+}
+
+func (s *stream) loadRecv(id string) *recvState {
+	if !streamIdReg.MatchString(id) {
+		return nil
+	}
+	if state, ok := s.recvs[id]; ok {
+		return state
+	}
+	// 重启后从文件恢复
+	str, err := qio.ReadAllBytes(s.recvFile(id, ".json"))
+	if err != nil {
+		return nil
+	}
+	state := &recvState{lock: &sync.Mutex{}}
+	if json.Unmarshal(str, state) != nil || !qio.PathExists(s.recvFile(id, ".part")) {
+		return nil
+	}
+	if len(state.Received) != chunkCount(state.Open.Size, state.Open.ChunkSize) {
+		return nil
+	}
+	s.recvs[id] = state
+	return state
+}
+
+// saveRecv 保存接收状态，调用方需持有该流的锁或该流尚未对外可见
+func (s *stream) saveRecv(state *recvState) {
+	state.saved = time.Now()
+	state.Time = qdefine.NewDateTime(state.saved)
+	js, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	_ = qio.WriteAllBytes(s.recvFile(state.Open.Id, ".json"), js, false)
+}
+
+func (s *stream) removeRecv(id string) {
+	if state, ok := s.recvs[id]; ok {
+		state.lock.Lock()
+		state.closeFile()
+		state.lock.Unlock()
+	}
+	delete(s.recvs, id)
+	_ = os.Remove(s.recvFile(id, ".json"))
+	_ = os.Remove(s.recvFile(id, ".part"))
+}
+
+// state 转为接收中的流状态
+func (state *recvState) state() models.StreamState {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	received := 0
+	for _, ok := range state.Received {
+		if ok {
+			received++
+		}
+	}
+	transferred := int64(received) * int64(state.Open.ChunkSize)
+	if transferred > state.Open.Size {
+		transferred = state.Open.Size
+	}
+	return models.StreamState{
+		Id:          state.Open.Id,
+		Name:        state.Open.Name,
+		Peer:        state.Open.Source,
+		Size:        state.Open.Size,
+		Transferred: transferred,
+		Status:      "Running",
+		Time:        state.Time,
+	}
+}
+
+// closeFile 关闭临时文件，调用方需持有该流的锁
+func (state *recvState) closeFile() {
+	if state.file != nil {
+		_ = state.file.Close()
+		state.file = nil
+	}
+}
+
+func (s *stream) recvFile(id string, ext string) string {
+	return filepath.Join(qio.GetFullPath(config.Stream.Dir), id+ext)
+}
+
+func chunkCount(size int64, chunkSize int) int {
+	return int((size + int64(chunkSize) - 1) / int64(chunkSize))
+}
+
+func nextMissing(received []bool) int {
+	for i, ok := range received {
+		if !ok {
+			return i
+		}
+	}
+	return len(received)
+}
+
+// diskFree 目录所在磁盘的可用空间，目录不存在时先创建
+func diskFree(dir string) (int64, error) {
+	if _, err := qio.CreateDirectory(dir); err != nil {
+		return 0, err
+	}
+	usage, err := disk.Usage(dir)
+	if err != nil {
+		return 0, err
+	}
+	return int64(usage.Free), nil
+}
+
+func fileSha256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isRetryable 是否为断线等可恢复的路由错误
+func isRetryable(err error) bool {
+	var rErr *models.RouteError
+	if !errors.As(err, &rErr) {
+		return false
+	}
+	switch rErr.Code {
+	case models.ERouteErrTimeout, models.ERouteErrUpstream, models.ERouteErrDeviceOffline:
+		return true
+	}
+	return false
+}
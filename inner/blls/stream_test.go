@@ -0,0 +1,222 @@
+package blls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"router/inner/config"
+	"router/inner/models"
+	"testing"
+)
+
+func TestChunkCount(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int64
+		chunkSize int
+		want      int
+	}{
+		{"空流", 0, 4, 0},
+		{"整块", 8, 4, 2},
+		{"最后一块不满", 9, 4, 3},
+		{"小于一块", 3, 4, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chunkCount(tt.size, tt.chunkSize); got != tt.want {
+				t.Errorf("chunkCount(%d, %d) = %d, want %d", tt.size, tt.chunkSize, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextMissing(t *testing.T) {
+	tests := []struct {
+		name     string
+		received []bool
+		want     int
+	}{
+		{"全部未收到", []bool{false, false}, 0},
+		{"中间缺块", []bool{true, false, true}, 1},
+		{"全部收到", []bool{true, true}, 2},
+		{"空流", []bool{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextMissing(tt.received); got != tt.want {
+				t.Errorf("nextMissing(%v) = %d, want %d", tt.received, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamRecv(t *testing.T) {
+	data := []byte("0123456789")
+	sum := sha256.Sum256(data)
+	good := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		seqs    []int  // 依次发送的块
+		badCrc  bool   // 块校验错误
+		sha256  string // 关闭时的校验值
+		wantErr bool
+	}{
+		{"完整接收", []int{0, 1, 2}, false, good, false},
+		{"乱序接收", []int{2, 0, 1, 1}, false, good, false},
+		{"缺块", []int{0, 2}, false, good, true},
+		{"块校验错误", []int{0, 1, 2}, true, good, true},
+		{"内容校验错误", []int{0, 1, 2}, false, "00", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Stream.Dir = t.TempDir()
+			config.Stream.MaxSize = 0
+			var got []byte
+			s := newStreamBll(nil, nil, func(open models.StreamOpen, file string) error {
+				got, _ = os.ReadFile(file)
+				return nil
+			})
+			open := models.StreamOpen{Id: "s1", Name: "a.bin", Size: int64(len(data)), ChunkSize: 4}
+			if _, err := s.Open(open); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			for _, seq := range tt.seqs {
+				if _, err = s.Chunk(testChunk(open, data, seq, tt.badCrc)); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				_, err = s.Close(models.StreamClose{Id: open.Id, Sha256: tt.sha256})
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("recv error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, data) {
+				t.Errorf("received = %q, want %q", got, data)
+			}
+			if st, ok := s.RecvState(open.Id); !tt.wantErr && (!ok || st.Status != "Done") {
+				t.Errorf("RecvState() = %+v, %v", st, ok)
+			}
+		})
+	}
+}
+
+func TestStreamResume(t *testing.T) {
+	data := []byte("0123456789")
+	open := models.StreamOpen{Id: "s2", Name: "a.bin", Size: int64(len(data)), ChunkSize: 4}
+
+	tests := []struct {
+		name     string
+		open     models.StreamOpen
+		wantNext int
+	}{
+		{"重启后续传", open, 1},
+		{"大小变化重新接收", models.StreamOpen{Id: open.Id, Size: 12, ChunkSize: 4}, 0},
+		{"块大小变化重新接收", models.StreamOpen{Id: open.Id, Size: open.Size, ChunkSize: 2}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Stream.Dir = t.TempDir()
+			config.Stream.MaxSize = 0
+			s := newStreamBll(nil, nil, nil)
+			if _, err := s.Open(open); err != nil {
+				t.Fatal(err)
+			}
+			for _, seq := range []int{0, 2} {
+				if _, err := s.Chunk(testChunk(open, data, seq, false)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 模拟重启前保存了状态
+			state := s.recvs[open.Id]
+			state.lock.Lock()
+			s.saveRecv(state)
+			state.closeFile()
+			state.lock.Unlock()
+
+			restarted := newStreamBll(nil, nil, nil)
+			ack, err := restarted.Open(tt.open)
+			if err != nil || ack.Next != tt.wantNext {
+				t.Fatalf("Open() = %+v, %v, want next %d", ack, err, tt.wantNext)
+			}
+			restarted.lock.Lock()
+			restarted.removeRecv(open.Id)
+			restarted.lock.Unlock()
+		})
+	}
+}
+
+func TestStreamOpenLimit(t *testing.T) {
+	config.Stream.Dir = t.TempDir()
+	tests := []struct {
+		name    string
+		max     int64
+		open    models.StreamOpen
+		wantErr bool
+	}{
+		{"正常", 0, models.StreamOpen{Id: "a1", Size: 10, ChunkSize: 4}, false},
+		{"超出配置大小", 5, models.StreamOpen{Id: "a2", Size: 10, ChunkSize: 4}, true},
+		{"超出磁盘可用空间", 0, models.StreamOpen{Id: "a3", Size: 1 << 62, ChunkSize: 4}, true},
+		{"非法Id", 0, models.StreamOpen{Id: "../a4", Size: 10, ChunkSize: 4}, true},
+		{"块大小为0", 0, models.StreamOpen{Id: "a5", Size: 10}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Stream.MaxSize = tt.max
+			s := newStreamBll(nil, nil, nil)
+			_, err := s.Open(tt.open)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			s.lock.Lock()
+			s.removeRecv(tt.open.Id)
+			s.lock.Unlock()
+		})
+	}
+	config.Stream.MaxSize = 0
+}
+
+func TestStreamKeep(t *testing.T) {
+	config.Stream.Dir = t.TempDir()
+	s := newStreamBll(nil, nil, nil)
+	tests := []struct {
+		name string
+		open models.StreamOpen
+		want string
+	}{
+		{"文件名", models.StreamOpen{Id: "k1", Name: "a.txt"}, "k1_a.txt"},
+		{"名称包含路径", models.StreamOpen{Id: "k2", Name: `..\..\b.txt`}, "k2_b.txt"},
+		{"空名称", models.StreamOpen{Id: "k3"}, "k3_data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part := filepath.Join(config.Stream.Dir, tt.open.Id+".part")
+			_ = os.WriteFile(part, []byte("x"), 0644)
+			file, err := s.Keep(tt.open, part)
+			if err != nil || file != filepath.Join(config.Stream.Dir, "received", tt.want) {
+				t.Fatalf("Keep() = %q, %v, want %q", file, err, tt.want)
+			}
+			if _, err = os.Stat(file); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func testChunk(open models.StreamOpen, data []byte, seq int, badCrc bool) models.StreamChunk {
+	end := (seq + 1) * open.ChunkSize
+	if end > len(data) {
+		end = len(data)
+	}
+	part := data[seq*open.ChunkSize : end]
+	crc := crc32.ChecksumIEEE(part)
+	if badCrc {
+		crc++
+	}
+	return models.StreamChunk{Id: open.Id, Seq: seq, Data: part, Crc: crc}
+}
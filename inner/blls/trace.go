@@ -0,0 +1,175 @@
+package blls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kamioair/qf/utils/qio"
+	"net/http"
+	"router/inner/config"
+	"router/inner/models"
+	"sync"
+	"time"
+)
+
+type tracer struct {
+	lock  *sync.Mutex
+	spans []models.TraceSpan // 待导出的记录
+}
+
+func newTracerBll() *tracer {
+	return &tracer{
+		lock:  &sync.Mutex{},
+		spans: make([]models.TraceSpan, 0),
+	}
+}
+
+// Start 启动导出
+func (t *tracer) Start() {
+	if config.Trace.Export == "" {
+		return
+	}
+	interval := config.Trace.Interval
+	if interval <= 0 {
+		interval = 5
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			t.export()
+		}
+	}()
+}
+
+// Begin 开始本跳的追踪，并将本跳Id写入请求，供下一跳使用
+func (t *tracer) Begin(info *models.RouteInfo) models.TraceSpan {
+	if info.Trace.TraceId == "" {
+		info.Trace.TraceId = newTraceId(16)
+	}
+	span := models.TraceSpan{
+		TraceId:  info.Trace.TraceId,
+		SpanId:   newTraceId(8),
+		ParentId: info.Trace.SpanId,
+		RouterId: config.DeviceId(),
+		Module:   info.Module,
+		Route:    info.Route,
+		Start:    time.Now(),
+	}
+	info.Trace.SpanId = span.SpanId
+	return span
+}
+
+// End 结束本跳的追踪，失败时将本跳加入错误的经过列表
+func (t *tracer) End(span models.TraceSpan, err error) error {
+	span.Duration = time.Since(span.Start).Microseconds()
+	span.Result = "OK"
+
+	var rErr *models.RouteError
+	if err != nil {
+		if !errors.As(err, &rErr) {
+			rErr = models.NewRouteError(models.ERouteErrRemote, config.DeviceId(), err.Error())
+		}
+		span.Result = rErr.Message
+		rErr.TraceId = span.TraceId
+		rErr.Hops = append([]models.TraceSpan{span}, rErr.Hops...)
+	}
+
+	if config.Trace.Export != "" {
+		t.lock.Lock()
+		t.spans = append(t.spans, span)
+		t.lock.Unlock()
+	}
+	if rErr != nil {
+		return rErr
+	}
+	return nil
+}
+
+// export 按OTLP/JSON格式导出
+func (t *tracer) export() {
+	t.lock.Lock()
+	spans := t.spans
+	t.spans = make([]models.TraceSpan, 0)
+	t.lock.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	js, err := json.Marshal(newOtlpTrace(spans))
+	if err != nil {
+		return
+	}
+	switch config.Trace.Export {
+	case "file":
+		_ = qio.WriteAllBytes(config.Trace.File, append(js, '\n'), true)
+	case "otlp":
+		client := http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Post(config.Trace.Endpoint, "application/json", bytes.NewReader(js))
+		if err != nil {
+			return
+		}
+		_ = resp.Body.Close()
+	}
+}
+
+func newOtlpTrace(spans []models.TraceSpan) map[string]any {
+	list := make([]map[string]any, 0)
+	for _, s := range spans {
+		status := map[string]any{"code": 1}
+		if s.Result != "OK" {
+			status = map[string]any{"code": 2, "message": s.Result}
+		}
+		end := s.Start.Add(time.Duration(s.Duration) * time.Microsecond)
+		list = append(list, map[string]any{
+			"traceId":           s.TraceId,
+			"spanId":            s.SpanId,
+			"parentSpanId":      s.ParentId,
+			"name":              fmt.Sprintf("%s/%s", s.Module, s.Route),
+			"kind":              2,
+			"startTimeUnixNano": fmt.Sprintf("%d", s.Start.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprintf("%d", end.UnixNano()),
+			"attributes": []map[string]any{
+				otlpAttr("route.router", s.RouterId),
+				otlpAttr("route.module", s.Module),
+				otlpAttr("route.route", s.Route),
+			},
+			"status": status,
+		})
+	}
+	return map[string]any{
+		"resourceSpans": []map[string]any{
+			{
+				"resource": map[string]any{
+					"attributes": []map[string]any{
+						otlpAttr("service.name", "Route"),
+						otlpAttr("service.instance.id", config.DeviceId()),
+					},
+				},
+				"scopeSpans": []map[string]any{
+					{
+						"scope": map[string]any{"name": "router"},
+						"spans": list,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttr(key, value string) map[string]any {
+	return map[string]any{
+		"key":   key,
+		"value": map[string]any{"stringValue": value},
+	}
+}
+
+// newTraceId 生成指定字节数的随机Id（十六进制）
+func newTraceId(size int) string {
+	buf := make([]byte, size)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,121 @@
+package blls
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kamioair/qf/utils/qio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"router/inner/config"
+	"router/inner/models"
+)
+
+var rolloutIdReg = regexp.MustCompile(`^[A-Za-z0-9\-]+$`)
+
+type updater struct {
+	controlBll *controller
+}
+
+func newUpdaterBll(controlBll *controller) *updater {
+	return &updater{
+		controlBll: controlBll,
+	}
+}
+
+// Install 备份旧版本，替换为沙箱中的更新包并重启模块，启动失败时自动还原
+func (u *updater) Install(req models.UpdateRequest) error {
+	target, ok := config.Update.Modules[req.Module]
+	if !ok || target.Path == "" {
+		return models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), fmt.Sprintf("module %s is not allowed to update", req.Module))
+	}
+	if req.Rollout != "" && !rolloutIdReg.MatchString(req.Rollout) {
+		return errors.New(fmt.Sprintf("rollout %s is invalid", req.Rollout))
+	}
+	pkg := sandboxPath(req.Package)
+	if !qio.PathExists(pkg) {
+		return errors.New(fmt.Sprintf("package %s not find", req.Package))
+	}
+
+	// 备份当前版本
+	backup := u.backupFile(req.Module, req.Rollout)
+	if _, err := qio.CreateDirectory(filepath.Dir(backup)); err != nil {
+		return err
+	}
+	if qio.PathExists(target.Path) {
+		if err := copyFile(target.Path, backup); err != nil {
+			return err
+		}
+	}
+
+	// 模块可能已经停止，忽略停止失败
+	_, _ = u.controlBll.Do(req.Module, "Stop")
+	if err := replaceFile(pkg, target.Path); err != nil {
+		// 未替换，本次备份不再需要
+		if req.Rollout != "" {
+			_ = os.Remove(backup)
+		}
+		_, _ = u.controlBll.Do(req.Module, "Start")
+		return err
+	}
+	if _, err := u.controlBll.Do(req.Module, "Start"); err != nil {
+		_, _ = u.Rollback(req.Module, req.Rollout)
+		return err
+	}
+	return nil
+}
+
+// Rollback 还原为更新前的版本并重启模块，返回是否已还原
+// 分批更新时只使用该次更新的备份，没有备份说明未替换，无需还原
+func (u *updater) Rollback(module, rollout string) (bool, error) {
+	target, ok := config.Update.Modules[module]
+	if !ok || target.Path == "" {
+		return false, models.NewRouteError(models.ERouteErrAccessDenied, config.DeviceId(), fmt.Sprintf("module %s is not allowed to update", module))
+	}
+	if rollout != "" && !rolloutIdReg.MatchString(rollout) {
+		return false, errors.New(fmt.Sprintf("rollout %s is invalid", rollout))
+	}
+	backup := u.backupFile(module, rollout)
+	if !qio.PathExists(backup) {
+		if rollout != "" {
+			return false, nil
+		}
+		return false, errors.New(fmt.Sprintf("module %s has no backup", module))
+	}
+	_, _ = u.controlBll.Do(module, "Stop")
+	if err := replaceFile(backup, target.Path); err != nil {
+		return false, err
+	}
+	if rollout != "" {
+		// 已还原，避免重复回滚时再次使用
+		_ = os.Remove(backup)
+	}
+	_, err := u.controlBll.Do(module, "Start")
+	return true, err
+}
+
+// backupFile 备份文件，分批更新时按更新唯一号分目录保存
+func (u *updater) backupFile(module, rollout string) string {
+	if rollout != "" {
+		return filepath.Join(qio.GetFullPath(config.Update.BackupDir), rollout, module)
+	}
+	return filepath.Join(qio.GetFullPath(config.Update.BackupDir), module)
+}
+
+// replaceFile 先复制到同目录的临时文件再替换，保证原子性
+func replaceFile(source, target string) error {
+	tmp := target + ".tmp"
+	if err := copyFile(source, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
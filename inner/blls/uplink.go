@@ -0,0 +1,290 @@
+package blls
+
+import (
+	"fmt"
+	"github.com/kamioair/qf/qdefine"
+	easyCon "github.com/qiu-tec/easy-con.golang"
+	"router/inner/config"
+	"router/inner/models"
+	"sync"
+	"time"
+)
+
+// 健康检查的超时时间，与Broker配置的请求超时无关
+const uplinkHealthTimeout = 3 * time.Second
+
+type uplink struct {
+	lock     *sync.Mutex
+	brokers  []config.UpBroker // 按优先级排序的上级Broker
+	active   int               // 当前使用的Broker序号
+	adapter  easyCon.IAdapter  // 当前使用的上层Broker访问器
+	fails    int               // 连续检查失败次数
+	since    time.Time
+	switches int
+	failback time.Time // 最后一次检查更优先Broker的时间
+	linked   bool      // 当前Broker是否已连接
+	changed  time.Time // 连接状态最后变化的时间
+	flaps    int       // 连接断开次数
+	started  bool
+	connect  func(broker config.UpBroker, name string) (easyCon.IAdapter, error)
+	onLinked func() // 连接或切换后恢复连接
+}
+
+func newUplinkBll(connect func(broker config.UpBroker, name string) (easyCon.IAdapter, error), onLinked func()) *uplink {
+	u := &uplink{
+		lock:     &sync.Mutex{},
+		brokers:  config.UpBrokers(),
+		active:   -1,
+		changed:  time.Now(),
+		connect:  connect,
+		onLinked: onLinked,
+	}
+	// 启动时按优先级连接第一个可用的配置，连不上由健康检查切换
+	for i := range u.brokers {
+		if u.use(i) {
+			break
+		}
+	}
+	return u
+}
+
+// Configured 是否配置了上级Broker，未配置的服务路由为根路由
+func (u *uplink) Configured() bool {
+	return len(u.brokers) > 0
+}
+
+// Adapter 当前使用的上层Broker访问器
+func (u *uplink) Adapter() easyCon.IAdapter {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.adapter
+}
+
+// Linked 当前Broker是否已连接
+func (u *uplink) Linked() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.linked
+}
+
+// DownFor 连接断开的持续时间，已连接时为0
+func (u *uplink) DownFor() time.Duration {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.linked {
+		return 0
+	}
+	return time.Since(u.changed)
+}
+
+// State 当前使用的上级Broker及连接状态
+func (u *uplink) State() models.UplinkState {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.active < 0 {
+		return models.UplinkState{}
+	}
+	st := models.UplinkState{
+		Addr:      u.brokers[u.active].Addr,
+		Priority:  u.brokers[u.active].Priority,
+		Since:     qdefine.NewDateTime(u.since),
+		Switches:  u.switches,
+		Linked:    u.linked,
+		LinkSince: qdefine.NewDateTime(u.changed),
+		Flaps:     u.flaps,
+	}
+	if u.linked {
+		st.Uptime = int64(time.Since(u.changed).Seconds())
+	}
+	return st
+}
+
+// Start 启动健康检查
+func (u *uplink) Start() {
+	if !u.Configured() {
+		return
+	}
+	u.lock.Lock()
+	u.started = true
+	u.lock.Unlock()
+
+	go func() {
+		interval := time.Duration(config.Failover.CheckInterval) * time.Second
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			u.check()
+		}
+	}()
+}
+
+// OnStatus 上层Broker访问器的状态变化，临时连接和已替换的访问器忽略
+func (u *uplink) OnStatus(adapter easyCon.IAdapter, status easyCon.EStatus) {
+	u.lock.Lock()
+	current := u.adapter != nil && u.adapter == adapter
+	u.lock.Unlock()
+	if !current {
+		return
+	}
+	switch status {
+	case easyCon.EStatusLinked:
+		u.setLinked(true)
+	case easyCon.EStatusLinkLost, easyCon.EStatusFault:
+		u.setLinked(false)
+	}
+}
+
+// Reconnect 重新连接当前的Broker，用于更换登录凭证
+func (u *uplink) Reconnect() {
+	u.lock.Lock()
+	active := u.active
+	u.lock.Unlock()
+	if active >= 0 {
+		u.use(active)
+	}
+}
+
+// check 当前Broker连续失败时按优先级切换，使用备用Broker时定期尝试切回更优先的
+func (u *uplink) check() {
+	adapter := u.Adapter()
+	ok := adapter != nil && ping(adapter)
+	if ok {
+		// 状态通知可能早于访问器创建完成
+		u.setLinked(true)
+	}
+
+	u.lock.Lock()
+	if ok {
+		u.fails = 0
+	} else {
+		u.fails++
+	}
+	fails, active := u.fails, u.active
+	failback := active != 0 && time.Since(u.failback) >= time.Duration(config.Failover.FailbackInterval)*time.Second
+	if failback {
+		u.failback = time.Now()
+	}
+	u.lock.Unlock()
+
+	if !ok && fails >= config.Failover.MaxFails {
+		for i := range u.brokers {
+			if i != active && u.probe(i) && u.use(i) {
+				return
+			}
+		}
+		return
+	}
+	if ok && failback {
+		for i := 0; i < active; i++ {
+			if u.probe(i) && u.use(i) {
+				return
+			}
+		}
+	}
+}
+
+// probe 用临时连接检查Broker是否可用
+func (u *uplink) probe(index int) bool {
+	adapter, err := u.connect(u.brokers[index], fmt.Sprintf("Route.%s.[PROBE]", config.DeviceId()))
+	if err != nil {
+		return false
+	}
+	defer adapter.Stop()
+	time.Sleep(time.Second)
+
+	return ping(adapter)
+}
+
+// use 切换到指定的Broker，新的连接建立后再断开原来的，连不上时继续使用原来的
+func (u *uplink) use(index int) bool {
+	u.lock.Lock()
+	old := u.adapter
+	if old != nil && u.active == index {
+		// 重连同一个Broker时客户端Id相同，需先断开原来的
+		u.adapter = nil
+	} else {
+		old = nil
+	}
+	u.lock.Unlock()
+	if old != nil {
+		old.Stop()
+		u.setLinked(false)
+	}
+
+	broker := u.brokers[index]
+	adapter, err := u.connect(broker, "")
+	if err != nil {
+		fmt.Printf("[Uplink]:%s, %s\n", broker.Addr, err.Error())
+		return false
+	}
+	u.lock.Lock()
+	old = u.adapter
+	if u.active >= 0 && u.active != index {
+		u.switches++
+	}
+	u.adapter = adapter
+	u.active = index
+	u.fails = 0
+	u.since = time.Now()
+	u.lock.Unlock()
+	if old != nil {
+		old.Stop()
+	}
+	// 切换后需重新同步，先置为断开
+	u.setLinked(false)
+	time.Sleep(time.Second)
+
+	fmt.Printf("[Uplink]:use %s\n", broker.Addr)
+	if ping(adapter) {
+		u.setLinked(true)
+	}
+	return true
+}
+
+// setLinked 更新连接状态，恢复连接时通知路由重新同步
+func (u *uplink) setLinked(linked bool) {
+	u.lock.Lock()
+	if u.linked == linked {
+		u.lock.Unlock()
+		return
+	}
+	u.linked = linked
+	u.changed = time.Now()
+	if !linked && u.adapter != nil {
+		u.flaps++
+	}
+	notify := linked && u.started
+	u.lock.Unlock()
+
+	if notify {
+		go u.onLinked()
+	}
+}
+
+// ping 检查上级路由是否可用，旧版本的上级没有Health路由，有应答即视为可用
+func ping(adapter easyCon.IAdapter) bool {
+	var code easyCon.EResp
+	if h, ok := adapter.(interface {
+		ReqTimeout(module, route string, params any, timeout time.Duration) easyCon.PackResp
+	}); ok {
+		code = h.ReqTimeout("Route", "Health", nil, uplinkHealthTimeout).RespCode
+	} else {
+		// 访问器不支持指定超时，超时后不再等待应答
+		ch := make(chan easyCon.EResp, 1)
+		go func() { ch <- adapter.Req("Route", "Health", nil).RespCode }()
+		select {
+		case code = <-ch:
+		case <-time.After(uplinkHealthTimeout):
+			code = easyCon.ERespTimeout
+		}
+	}
+	return code != easyCon.ERespTimeout && code != easyCon.ERespUnLinked
+}
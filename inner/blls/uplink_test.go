@@ -0,0 +1,121 @@
+package blls
+
+import (
+	"errors"
+	"github.com/kamioair/qf/qdefine"
+	easyCon "github.com/qiu-tec/easy-con.golang"
+	"router/inner/config"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAdapter 测试用的上层Broker访问器
+type fakeAdapter struct {
+	addr    string
+	healthy bool
+	stopped atomic.Bool
+	block   time.Duration // 请求阻塞的时间
+}
+
+func (f *fakeAdapter) Stop()  { f.stopped.Store(true) }
+func (f *fakeAdapter) Reset() {}
+func (f *fakeAdapter) Req(module, route string, params any) easyCon.PackResp {
+	time.Sleep(f.block)
+	if !f.healthy || f.stopped.Load() {
+		return easyCon.PackResp{RespCode: easyCon.ERespTimeout}
+	}
+	return easyCon.PackResp{RespCode: easyCon.ERespSuccess}
+}
+func (f *fakeAdapter) SendNotice(route string, content any) error       { return nil }
+func (f *fakeAdapter) SendRetainNotice(route string, content any) error { return nil }
+func (f *fakeAdapter) Debug(content string)                             {}
+func (f *fakeAdapter) Warn(content string)                              {}
+func (f *fakeAdapter) Err(content string, err error)                    {}
+
+func TestUplinkFailover(t *testing.T) {
+	type broker struct {
+		addr    string
+		connect bool // 能否连上
+		healthy bool // 连上后健康检查是否成功
+	}
+	tests := []struct {
+		name     string
+		brokers  []broker
+		active   int // 开始时使用的Broker，-1为按启动流程选择
+		checks   int // 健康检查次数
+		failback int
+		want     string
+	}{
+		{"启动时跳过连不上的", []broker{{"a", false, false}, {"b", true, true}}, -1, 0, 60, "b"},
+		{"失败次数不够不切换", []broker{{"a", true, false}, {"b", true, true}}, 0, 2, 60, "a"},
+		{"连续失败后切换", []broker{{"a", true, false}, {"b", true, true}}, 0, 3, 60, "b"},
+		{"备用也不可用时继续使用原来的", []broker{{"a", true, false}, {"b", false, false}}, 0, 3, 60, "a"},
+		{"切回更优先的", []broker{{"a", true, true}, {"b", true, true}}, 1, 1, 0, "a"},
+		{"未到间隔不切回", []broker{{"a", true, true}, {"b", true, true}}, 1, 1, 60, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Failover.MaxFails = 3
+			config.Failover.FailbackInterval = tt.failback
+			u := &uplink{lock: &sync.Mutex{}, active: -1, changed: time.Now(), onLinked: func() {}}
+			for _, b := range tt.brokers {
+				u.brokers = append(u.brokers, config.UpBroker{BrokerConfig: qdefine.BrokerConfig{Addr: b.addr}})
+			}
+			u.connect = func(broker config.UpBroker, name string) (easyCon.IAdapter, error) {
+				for _, b := range tt.brokers {
+					if b.addr == broker.Addr && b.connect {
+						return &fakeAdapter{addr: b.addr, healthy: b.healthy}, nil
+					}
+				}
+				return nil, errors.New("connect failed")
+			}
+			if tt.active < 0 {
+				for i := range u.brokers {
+					if u.use(i) {
+						break
+					}
+				}
+			} else if !u.use(tt.active) {
+				t.Fatal("use() failed")
+			}
+			// 切回的间隔从最后一次检查开始计算
+			u.failback = time.Now()
+
+			for i := 0; i < tt.checks; i++ {
+				u.check()
+			}
+			adapter, _ := u.Adapter().(*fakeAdapter)
+			if adapter == nil || adapter.addr != tt.want || adapter.stopped.Load() {
+				t.Fatalf("adapter = %+v, want %s", adapter, tt.want)
+			}
+			if st := u.State(); st.Addr != tt.want {
+				t.Errorf("State().Addr = %s, want %s", st.Addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestUplinkPing(t *testing.T) {
+	tests := []struct {
+		name    string
+		adapter easyCon.IAdapter
+		want    bool
+	}{
+		{"正常", &fakeAdapter{healthy: true}, true},
+		{"超时", &fakeAdapter{}, false},
+		{"应答慢于健康检查超时", &fakeAdapter{healthy: true, block: uplinkHealthTimeout + time.Second}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			if got := ping(tt.adapter); got != tt.want {
+				t.Errorf("ping() = %v, want %v", got, tt.want)
+			}
+			if d := time.Since(start); d > uplinkHealthTimeout+500*time.Millisecond {
+				t.Errorf("ping() took %v", d)
+			}
+		})
+	}
+}
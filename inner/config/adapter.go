@@ -0,0 +1,302 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	easyCon "github.com/qiu-tec/easy-con.golang"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 连接上级Broker的超时时间，超时后由调用方换下一个Broker或稍后重试
+const upConnectTimeout = 10 * time.Second
+
+// 请求号，所有上级访问器共用，以启动时间为起点
+// 切换Broker或重启后重新订阅同一个响应主题，旧请求迟到的应答不会与新请求的号重复
+var upReqId atomic.Uint64
+
+func init() {
+	upReqId.Store(uint64(time.Now().UnixNano()))
+}
+
+// upAdapter 连接上级Broker的访问器，协议与easyCon一致
+// easyCon在创建时会一直重试连接，上级不可用时无法返回，因此首次连接改为有超时，连上后由paho自动重连
+type upAdapter struct {
+	client  mqtt.Client
+	setting easyCon.Setting
+	lock    *sync.Mutex
+	resps   map[uint64]upPending
+	linked  atomic.Bool
+}
+
+// upPending 等待应答的请求
+type upPending struct {
+	req easyCon.PackReq
+	ch  chan easyCon.PackResp
+}
+
+// NewUpAdapter 连接上级Broker，超时未连上返回错误
+func NewUpAdapter(broker UpBroker, setting easyCon.Setting) (easyCon.IAdapter, error) {
+	tlsConf, err := TlsConfig(broker)
+	if err != nil {
+		return nil, err
+	}
+	a := &upAdapter{
+		setting: setting,
+		lock:    &sync.Mutex{},
+		resps:   map[uint64]upPending{},
+	}
+	o := mqtt.NewClientOptions().
+		SetClientID(setting.Module).
+		AddBroker(broker.Addr).
+		SetUsername(setting.UID).
+		SetPassword(setting.PWD).
+		SetConnectTimeout(upConnectTimeout).
+		SetConnectRetry(false).
+		SetAutoReconnect(true).
+		SetOrderMatters(false)
+	if tlsConf != nil {
+		o.SetTLSConfig(tlsConf)
+	}
+	o.OnConnect = a.onConnect
+	o.OnConnectionLost = func(mqtt.Client, error) {
+		a.linked.Store(false)
+		a.status(easyCon.EStatusLinkLost)
+	}
+	o.OnReconnecting = func(mqtt.Client, *mqtt.ClientOptions) {
+		a.status(easyCon.EStatusConnecting)
+	}
+	a.client = mqtt.NewClient(o)
+
+	token := a.client.Connect()
+	if !token.WaitTimeout(upConnectTimeout + time.Second) {
+		a.client.Disconnect(0)
+		return nil, errors.New(fmt.Sprintf("connect %s timeout", broker.Addr))
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+	return a, nil
+}
+
+// Stop 断开连接
+func (a *upAdapter) Stop() {
+	a.linked.Store(false)
+	a.client.Disconnect(250)
+	a.status(easyCon.EStatusStopped)
+}
+
+// Reset 断开后重新连接
+func (a *upAdapter) Reset() {
+	a.Stop()
+	a.client.Connect()
+}
+
+// Req 请求，超时按配置的次数重试
+func (a *upAdapter) Req(module, route string, params any) easyCon.PackResp {
+	if !a.linked.Load() {
+		return easyCon.PackResp{RespCode: easyCon.ERespUnLinked}
+	}
+	pack := a.newReq(module, route, params)
+	for retry := a.setting.ReTry; retry > 0; retry-- {
+		resp := a.req(pack, a.setting.TimeOut)
+		if resp.RespCode != easyCon.ERespTimeout {
+			return resp
+		}
+	}
+	return easyCon.PackResp{PackReq: pack, RespCode: easyCon.ERespTimeout, Error: "Req timeout"}
+}
+
+// ReqTimeout 按指定的超时时间请求一次，不重试，用于健康检查
+func (a *upAdapter) ReqTimeout(module, route string, params any, timeout time.Duration) easyCon.PackResp {
+	if !a.linked.Load() {
+		return easyCon.PackResp{RespCode: easyCon.ERespUnLinked}
+	}
+	pack := a.newReq(module, route, params)
+	resp := a.req(pack, timeout)
+	if resp.RespCode == easyCon.ERespTimeout {
+		return easyCon.PackResp{PackReq: pack, RespCode: easyCon.ERespTimeout, Error: "Req timeout"}
+	}
+	return resp
+}
+
+// SendNotice 发送通知
+func (a *upAdapter) SendNotice(route string, content any) error {
+	return a.sendNotice(route, false, content)
+}
+
+// SendRetainNotice 发送保留通知
+func (a *upAdapter) SendRetainNotice(route string, content any) error {
+	return a.sendNotice(route, true, content)
+}
+
+func (a *upAdapter) Debug(content string) {
+	a.log(easyCon.ELogLevelDebug, content, nil)
+}
+
+func (a *upAdapter) Warn(content string) {
+	a.log(easyCon.ELogLevelWarning, content, nil)
+}
+
+func (a *upAdapter) Err(content string, err error) {
+	a.log(easyCon.ELogLevelError, content, err)
+}
+
+func (a *upAdapter) onConnect(client mqtt.Client) {
+	subs := map[string]mqtt.MessageHandler{
+		"Request_" + a.setting.Module:  a.onReq,
+		"Response_" + a.setting.Module: a.onResp,
+	}
+	if a.setting.OnNotice != nil {
+		subs[a.setting.PreFix+easyCon.NoticeTopic] = a.onNotice
+	}
+	for topic, handler := range subs {
+		token := client.Subscribe(topic, 0, handler)
+		if token.Wait() && token.Error() != nil {
+			a.Err(topic+" subscribe error", token.Error())
+		}
+	}
+	a.linked.Store(true)
+	a.status(easyCon.EStatusLinked)
+}
+
+func (a *upAdapter) onReq(_ mqtt.Client, msg mqtt.Message) {
+	pack := easyCon.PackReq{}
+	if err := json.Unmarshal(msg.Payload(), &pack); err != nil {
+		a.Err("REQ unmarshal error", err)
+		return
+	}
+	code, content := easyCon.ERespRouteNotFind, any(nil)
+	if a.setting.OnReq != nil {
+		code, content = a.setting.OnReq(pack)
+	}
+	resp := easyCon.PackResp{
+		PackReq:  pack,
+		RespTime: time.Now().Format("2006-01-02 15:04:05.000"),
+		RespCode: code,
+	}
+	resp.PType = easyCon.EPTypeResp
+	resp.Content = content
+	js, err := json.Marshal(resp)
+	if err != nil {
+		a.Err("RESP marshal error", err)
+		return
+	}
+	token := a.client.Publish("Response_"+pack.From, 0, false, js)
+	if token.Wait() && token.Error() != nil {
+		a.Err("RESP send error", token.Error())
+	}
+}
+
+func (a *upAdapter) onResp(_ mqtt.Client, msg mqtt.Message) {
+	pack := easyCon.PackResp{}
+	if err := json.Unmarshal(msg.Payload(), &pack); err != nil {
+		a.Err("RESP unmarshal error", err)
+		return
+	}
+	a.lock.Lock()
+	p, ok := a.resps[pack.Id]
+	a.lock.Unlock()
+	// 请求号相同但不是发给本请求的应答，忽略
+	if !ok || pack.From != p.req.From || pack.To != p.req.To || pack.Route != p.req.Route {
+		return
+	}
+	select {
+	case p.ch <- pack:
+	default:
+	}
+}
+
+func (a *upAdapter) onNotice(_ mqtt.Client, msg mqtt.Message) {
+	notice := easyCon.PackNotice{}
+	if err := json.Unmarshal(msg.Payload(), &notice); err != nil {
+		a.Err("Notice unmarshal error", err)
+		return
+	}
+	a.setting.OnNotice(notice)
+}
+
+func (a *upAdapter) newReq(module, route string, params any) easyCon.PackReq {
+	pack := easyCon.PackReq{
+		From:    a.setting.Module,
+		ReqTime: time.Now().Format("2006-01-02 15:04:05.000"),
+		To:      module,
+		Route:   route,
+		Content: params,
+	}
+	pack.PType = easyCon.EPTypeReq
+	pack.Id = upReqId.Add(1)
+	return pack
+}
+
+func (a *upAdapter) req(pack easyCon.PackReq, timeout time.Duration) easyCon.PackResp {
+	js, err := json.Marshal(pack)
+	if err != nil {
+		return easyCon.PackResp{RespCode: easyCon.ERespBadReq, Error: err.Error()}
+	}
+	ch := make(chan easyCon.PackResp, 1)
+	a.lock.Lock()
+	a.resps[pack.Id] = upPending{req: pack, ch: ch}
+	a.lock.Unlock()
+	defer func() {
+		a.lock.Lock()
+		delete(a.resps, pack.Id)
+		a.lock.Unlock()
+	}()
+
+	token := a.client.Publish("Request_"+pack.To, 0, false, js)
+	if token.Wait() && token.Error() != nil {
+		return easyCon.PackResp{RespCode: easyCon.ERespUnLinked}
+	}
+	select {
+	case resp := <-ch:
+		return resp
+	case <-time.After(timeout):
+		return easyCon.PackResp{RespCode: easyCon.ERespTimeout}
+	}
+}
+
+func (a *upAdapter) sendNotice(route string, retain bool, content any) error {
+	if !a.linked.Load() {
+		return errors.New("adapter is not linked")
+	}
+	pack := easyCon.PackNotice{
+		From:    a.setting.Module,
+		Route:   route,
+		Content: content,
+	}
+	pack.PType = easyCon.EPTypeNotice
+	js, err := json.Marshal(pack)
+	if err != nil {
+		return err
+	}
+	topic := a.setting.PreFix + easyCon.NoticeTopic
+	if retain {
+		topic = easyCon.RetainNoticeTopic
+	}
+	token := a.client.Publish(topic, 0, retain, js)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+func (a *upAdapter) status(status easyCon.EStatus) {
+	if a.setting.StatusChanged != nil {
+		a.setting.StatusChanged(a, status)
+	}
+}
+
+func (a *upAdapter) log(level easyCon.ELogLevel, content string, err error) {
+	if a.setting.LogMode != easyCon.ELogModeConsole && a.setting.LogMode != easyCon.ELogModeAll {
+		return
+	}
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+	fmt.Printf("[%s][%s][%s]: %s %s \r\n", time.Now().Format("2006-01-02 15:04:05.000"), level, a.setting.Module, content, errStr)
+}
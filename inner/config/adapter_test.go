@@ -0,0 +1,241 @@
+package config
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/kamioair/qf/qdefine"
+	easyCon "github.com/qiu-tec/easy-con.golang"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBroker 只支持QoS0的最小MQTT Broker，用于验证与easyCon的协议一致
+type testBroker struct {
+	ln   net.Listener
+	lock sync.Mutex
+	subs map[string][]*testConn
+}
+
+type testConn struct {
+	conn net.Conn
+	lock sync.Mutex
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{ln: ln, subs: map[string][]*testConn{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&testConn{conn: conn})
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return b
+}
+
+func (b *testBroker) addr() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *testBroker) serve(c *testConn) {
+	defer func() {
+		_ = c.conn.Close()
+		b.lock.Lock()
+		for topic, list := range b.subs {
+			for i, s := range list {
+				if s == c {
+					b.subs[topic] = append(list[:i], list[i+1:]...)
+					break
+				}
+			}
+		}
+		b.lock.Unlock()
+	}()
+	r := bufio.NewReader(c.conn)
+	for {
+		head, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		body := make([]byte, size)
+		if _, err = io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch head >> 4 {
+		case 1: // CONNECT
+			c.write(0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			n := int(binary.BigEndian.Uint16(body))
+			topic := string(body[2 : 2+n])
+			b.lock.Lock()
+			list := append([]*testConn{}, b.subs[topic]...)
+			b.lock.Unlock()
+			for _, s := range list {
+				s.write(0x30, body)
+			}
+		case 8: // SUBSCRIBE
+			ack := append([]byte{}, body[:2]...)
+			for i := 2; i < len(body); {
+				n := int(binary.BigEndian.Uint16(body[i:]))
+				topic := string(body[i+2 : i+2+n])
+				i += 3 + n
+				b.lock.Lock()
+				b.subs[topic] = append(b.subs[topic], c)
+				b.lock.Unlock()
+				ack = append(ack, 0)
+			}
+			c.write(0x90, ack)
+		case 10: // UNSUBSCRIBE
+			c.write(0xB0, body[:2])
+		case 12: // PINGREQ
+			c.write(0xD0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (c *testConn) write(head byte, body []byte) {
+	buf := append([]byte{head}, binary.AppendUvarint(nil, uint64(len(body)))...)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, _ = c.conn.Write(append(buf, body...))
+}
+
+func TestUpAdapterWithEasyCon(t *testing.T) {
+	broker := newTestBroker(t)
+	onReq := func(pack easyCon.PackReq) (easyCon.EResp, any) {
+		return easyCon.ERespSuccess, map[string]any{"To": pack.To, "Route": pack.Route, "Content": pack.Content}
+	}
+	status := func(easyCon.IAdapter, easyCon.EStatus) {}
+
+	lib := easyCon.NewSetting("Lib", broker.addr(), onReq, status)
+	lib.LogMode = easyCon.ELogModeNone
+	notices := make(chan easyCon.PackNotice, 1)
+	lib.OnNotice = func(notice easyCon.PackNotice) { notices <- notice }
+	libAdapter := easyCon.NewMqttAdapter(lib)
+	defer libAdapter.Stop()
+
+	linked := make(chan struct{}, 1)
+	up := easyCon.NewSetting("Up", broker.addr(), onReq, func(_ easyCon.IAdapter, s easyCon.EStatus) {
+		if s == easyCon.EStatusLinked {
+			linked <- struct{}{}
+		}
+	})
+	up.LogMode = easyCon.ELogModeNone
+	upper, err := NewUpAdapter(UpBroker{BrokerConfig: qdefine.BrokerConfig{Addr: broker.addr()}}, up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upper.Stop()
+	// 订阅完成后才算连上
+	select {
+	case <-linked:
+	case <-time.After(3 * time.Second):
+		t.Fatal("up adapter not linked")
+	}
+
+	tests := []struct {
+		name    string
+		from    easyCon.IAdapter
+		to      string
+		route   string
+		content any
+	}{
+		{"本访问器请求easyCon", upper, "Lib", "Ping", "up"},
+		{"easyCon请求本访问器", libAdapter, "Up", "Ping", "lib"},
+		{"结构体内容", upper, "Lib", "KnockDoor", map[string]any{"Id": "dev"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := tt.from.Req(tt.to, tt.route, tt.content)
+			if resp.RespCode != easyCon.ERespSuccess {
+				t.Fatalf("Req() code = %d %s", resp.RespCode, resp.Error)
+			}
+			if resp.PType != easyCon.EPTypeResp || resp.To != tt.to || resp.Route != tt.route {
+				t.Errorf("Req() resp = %+v", resp.PackReq)
+			}
+			got, _ := json.Marshal(resp.Content)
+			want, _ := json.Marshal(map[string]any{"To": tt.to, "Route": tt.route, "Content": tt.content})
+			if string(got) != string(want) {
+				t.Errorf("Req() content = %s, want %s", got, want)
+			}
+		})
+	}
+
+	if err = upper.SendNotice("RouteTest", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-notices:
+		if n.From != "Up" || n.Route != "RouteTest" || n.Content != "hello" || n.PType != easyCon.EPTypeNotice {
+			t.Errorf("notice = %+v", n)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("notice not received")
+	}
+
+	// 健康检查按指定的超时时间只请求一次
+	start := time.Now()
+	if resp := upper.(*upAdapter).ReqTimeout("None", "Health", nil, 200*time.Millisecond); resp.RespCode != easyCon.ERespTimeout {
+		t.Errorf("ReqTimeout() code = %d", resp.RespCode)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("ReqTimeout() took %v", d)
+	}
+}
+
+func TestUpAdapterLateResp(t *testing.T) {
+	a := &upAdapter{lock: &sync.Mutex{}, resps: map[uint64]upPending{}}
+	req := easyCon.PackReq{From: "Up", To: "Lib", Route: "Ping"}
+	req.Id = upReqId.Add(1)
+
+	tests := []struct {
+		name string
+		resp easyCon.PackReq
+		want bool
+	}{
+		{"其他请求的应答", easyCon.PackReq{From: "Up", To: "Lib", Route: "Heart"}, false},
+		{"其他模块的应答", easyCon.PackReq{From: "Up", To: "Other", Route: "Ping"}, false},
+		{"本请求的应答", req, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan easyCon.PackResp, 1)
+			a.resps[req.Id] = upPending{req: req, ch: ch}
+			resp := easyCon.PackResp{PackReq: tt.resp, RespCode: easyCon.ERespSuccess}
+			resp.Id = req.Id
+			js, _ := json.Marshal(resp)
+			a.onResp(nil, testMessage(js))
+			if got := len(ch) == 1; got != tt.want {
+				t.Errorf("onResp() matched = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testMessage 实现mqtt.Message
+type testMessage []byte
+
+func (m testMessage) Duplicate() bool   { return false }
+func (m testMessage) Qos() byte         { return 0 }
+func (m testMessage) Retained() bool    { return false }
+func (m testMessage) Topic() string     { return "" }
+func (m testMessage) MessageID() uint16 { return 0 }
+func (m testMessage) Payload() []byte   { return m }
+func (m testMessage) Ack()              {}
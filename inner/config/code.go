@@ -9,131 +9,430 @@ import (
 	"github.com/kamioair/qf/utils/qconfig"
 	"github.com/kamioair/qf/utils/qio"
 	easyCon "github.com/qiu-tec/easy-con.golang"
+	"os"
+	"path/filepath"
+	"router/inner/models"
 	"runtime"
+	"sync"
 	"time"
 )
 
+// DeviceId 本次运行使用的设备码
 func DeviceId() string {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
 	return device.info.Id
 }
 
 func DeviceName() string {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
 	return device.info.Name
 }
 
+// DeviceDesc 设备描述
+func DeviceDesc() string {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	return device.info.Desc
+}
+
+// SetDeviceName 修改设备名称并保存
+func SetDeviceName(name string) error {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	info := device.info
+	info.Name = name
+	return device.update(info)
+}
+
+// SetDeviceDesc 修改设备描述并保存
+func SetDeviceDesc(desc string) error {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	info := device.info
+	info.Desc = desc
+	return device.update(info)
+}
+
+// DeviceTags 设备标签，配置中的标签加上在根路由编辑的标签，值为空表示删除
+func DeviceTags() map[string]string {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	tags := map[string]string{}
+	for k, v := range Tags {
+		tags[k] = v
+	}
+	for k, v := range device.info.Tags {
+		if v == "" {
+			delete(tags, k)
+			continue
+		}
+		tags[k] = v
+	}
+	return tags
+}
+
+// SetDeviceTags 保存在根路由编辑的设备标签
+func SetDeviceTags(tags map[string]string) error {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	info := device.info
+	info.Tags = tags
+	return device.update(info)
+}
+
+// DeviceCredential 根路由签发的设备凭证及签发时间，未签发时为空
+func DeviceCredential() (string, qdefine.DateTime) {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	return device.info.Credential, device.info.CredentialTime
+}
+
+// SetDeviceCredential 保存根路由签发的设备凭证
+func SetDeviceCredential(credential string) error {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	info := device.info
+	info.Credential = credential
+	info.CredentialTime = qdefine.NewDateTime(time.Now())
+	return device.update(info)
+}
+
+// 本次启动的实例号
+var instanceId = qdefine.NewUUID()
+
+// InstanceId 本次启动的实例号，用于识别设备码重复
+func InstanceId() string {
+	return instanceId
+}
+
 var device deviceCode
 
 type deviceCode struct {
-	info qdefine.DeviceInfo
+	lock   sync.Mutex
+	info   codeInfo
+	file   string // 设备码文件
+	source string // 文件位置的来源
+}
+
+// codeInfo 设备码文件内容
+type codeInfo struct {
+	qdefine.DeviceInfo
+	Desc           string            // 设备描述
+	Tags           map[string]string // 在根路由编辑的设备标签
+	Provisional    bool              // 是否为本地生成的临时设备码
+	Origin         string            // 设备码来源：Fixed、Upper、Provisional、Confirmed
+	Credential     string            // 根路由签发的设备凭证
+	CredentialTime qdefine.DateTime  // 凭证签发时间
+	SignKey        string            // 消息签名私钥
+	Pending        *pendingCode      // 根路由分配的新设备码，重启后生效
+}
+
+// pendingCode 等待重启生效的新设备码及其凭证，运行中仍使用原设备码和原凭证
+type pendingCode struct {
+	Id             string           // 新设备码
+	Credential     string           // 新设备码的凭证
+	CredentialTime qdefine.DateTime // 凭证签发时间
 }
 
 // LoadFromFile 从文件中获取设备码
 func (d *deviceCode) loadFromFile(mode qservice.EServerMode) {
-	file := d.getCodeFile()
+	d.file, d.source = codeFile()
+	file := d.file
+	if !qio.PathExists(file) && d.source == "default" && qio.PathExists(legacyCodeFile) {
+		// 兼容旧版本的位置，读取后保存到新位置
+		file = legacyCodeFile
+		d.source = "legacy " + legacyCodeFile
+	}
 	if qio.PathExists(file) {
 		// 文件存在，则从文件中获取设备信息
 		str, err := qio.ReadAllString(file)
 		if err != nil {
 			goto newId
 		}
-		info := qdefine.DeviceInfo{}
+		info := codeInfo{}
 		err = json.Unmarshal([]byte(str), &info)
 		if err != nil {
 			goto newId
 		}
+		if info.SignKey == "" {
+			// 旧版本的设备码文件没有签名私钥，生成后保存
+			info.SignKey = newSignKey()
+			file = ""
+		}
+		if p := info.Pending; p != nil {
+			// 上次运行时分配了新的设备码，启动时生效
+			info.Id = p.Id
+			info.Credential = p.Credential
+			info.CredentialTime = p.CredentialTime
+			info.Origin = "Upper"
+			info.Pending = nil
+			file = ""
+		}
 		d.info = info
+		if file != d.file {
+			if err = d.saveToFile(info); err != nil {
+				fmt.Printf("[Provision]:save device code failed, %s\n", err.Error())
+			}
+		}
 		return
 	}
 	// 否则向上级路由请求一个新的ID
 newId:
-	var info qdefine.DeviceInfo
-	if mode == qservice.EModeServer {
+	var info codeInfo
+	info.SignKey = newSignKey()
+	if mode == qservice.EModeServer && len(UpBrokers()) == 0 {
 		// 说明是最顶级路由，直接分配一个固定的设备
-		if UpMqtt.Addr == "" {
-			info = qdefine.DeviceInfo{
-				Id:   "root",
-				Name: "Root Server",
-			}
-		} else {
-			// 创建临时连接，并问上级路由模块请求
-			setting := easyCon.NewSetting(fmt.Sprintf("Route.%s", qdefine.NewUUID()+".[TEMP]"), UpMqtt.Addr, onReq, onStatus)
-			setting.UID = UpMqtt.UId
-			setting.PWD = UpMqtt.Pwd
-			setting.TimeOut = time.Duration(UpMqtt.TimeOut) * time.Second
-			setting.ReTry = UpMqtt.Retry
-			setting.LogMode = easyCon.ELogMode(UpMqtt.LogMode)
-			adapter := easyCon.NewMqttAdapter(setting)
-			time.Sleep(time.Second)
-			resp := adapter.Req("Route", "NewDeviceId", nil)
-			if resp.RespCode == easyCon.ERespSuccess {
-				info = qdefine.DeviceInfo{Id: resp.Content.(string)}
-			} else {
-				panic(resp.Error)
-			}
-			// 执行请求
-			adapter.Stop()
-		}
+		info.Id = "root"
+		info.Name = "Root Server"
+		info.Origin = "Fixed"
 	} else {
-		// 客户端，直接问服务器的根路由请求
-		broker := qdefine.BrokerConfig{
-			Addr:    qconfig.Get("", "mqtt.addr", "ws://127.0.0.1:5002/ws"),
-			UId:     qconfig.Get("", "mqtt.uid", ""),
-			Pwd:     qconfig.Get("", "mqtt.pwd", ""),
-			LogMode: qconfig.Get("", "mqtt.logMode", "NONE"),
-			TimeOut: qconfig.Get("", "mqtt.timeOut", 3000),
-			Retry:   qconfig.Get("", "mqtt.retry", 3),
+		brokers := make([]UpBroker, 0)
+		if mode == qservice.EModeServer {
+			// 按优先级使用所有上级Broker
+			brokers = UpBrokers()
+		} else {
+			// 客户端，直接问服务器的根路由请求
+			brokers = append(brokers, UpBroker{BrokerConfig: qdefine.BrokerConfig{
+				Addr:    qconfig.Get("", "mqtt.addr", "ws://127.0.0.1:5002/ws"),
+				UId:     qconfig.Get("", "mqtt.uid", ""),
+				Pwd:     qconfig.Get("", "mqtt.pwd", ""),
+				LogMode: qconfig.Get("", "mqtt.logMode", "NONE"),
+				TimeOut: qconfig.Get("", "mqtt.timeOut", 3000),
+				Retry:   qconfig.Get("", "mqtt.retry", 3),
+			}})
 		}
-		setting := easyCon.NewSetting(fmt.Sprintf("Route.%s", qdefine.NewUUID()+".[TEMP]"), broker.Addr, onReq, onStatus)
-		setting.UID = broker.UId
-		setting.PWD = broker.Pwd
-		setting.TimeOut = time.Duration(broker.TimeOut) * time.Second
-		setting.ReTry = broker.Retry
-		setting.LogMode = easyCon.ELogMode(broker.LogMode)
-		adapter := easyCon.NewMqttAdapter(setting)
-		time.Sleep(time.Second)
-		resp := adapter.Req("Route", "NewDeviceId", nil)
-		if resp.RespCode == easyCon.ERespSuccess {
-			info = qdefine.DeviceInfo{Id: resp.Content.(string)}
+		req := NewEnrollRequest("")
+		req.PublicKey = publicKey(info.SignKey)
+		info.Name = req.Name
+		grant, err := provision(brokers, req)
+		if err != nil {
+			// 上级一直无法连接，先使用本地生成的临时设备码，连通后再向根路由确认
+			fmt.Printf("[Provision]:%s, use provisional id\n", err.Error())
+			info.Id = qdefine.NewUUID()
+			info.Provisional = true
+			info.Origin = "Provisional"
 		} else {
-			panic(resp.Error)
+			info.Id = grant.DeviceId
+			info.Origin = "Upper"
+			if grant.Credential != "" {
+				info.Credential = grant.Credential
+				info.CredentialTime = qdefine.NewDateTime(time.Now())
+			}
 		}
-		// 执行请求
-		adapter.Stop()
 	}
-	// 保存文件
+	// 保存文件，失败时仅本次运行有效
 	err := d.saveToFile(info)
 	if err != nil {
-		panic(err)
+		fmt.Printf("[Provision]:save device code failed, %s\n", err.Error())
+	}
+	d.info = info
+}
+
+// provision 依次向上级Broker申请设备码，都失败时按指数退避重试，直到超时
+func provision(brokers []UpBroker, req models.EnrollRequest) (models.DeviceGrant, error) {
+	if len(brokers) == 0 {
+		return models.DeviceGrant{}, errors.New("no upper broker available")
+	}
+	deadline := time.Now().Add(time.Duration(Provision.Timeout) * time.Second)
+	wait := time.Second
+	for i := 1; ; i++ {
+		for _, broker := range brokers {
+			grant, err := requestId(broker, "NewDeviceId", req)
+			if err == nil {
+				return grant, nil
+			}
+			fmt.Printf("[Provision]:request device id from %s failed (%d), %s\n", broker.Addr, i, err.Error())
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return models.DeviceGrant{}, errors.New(fmt.Sprintf("request device id timeout after %d tries", i))
+		}
+		time.Sleep(wait)
+		wait *= 2
+		if limit := time.Duration(Provision.MaxBackoff) * time.Second; limit > 0 && wait > limit {
+			wait = limit
+		}
+	}
+}
+
+// requestId 创建临时连接，向上级路由模块请求设备码，连接有超时，上级不可用时返回错误
+func requestId(broker UpBroker, route string, content any) (models.DeviceGrant, error) {
+	setting := easyCon.NewSetting(fmt.Sprintf("Route.%s", qdefine.NewUUID()+".[TEMP]"), broker.Addr, onReq, onStatus)
+	setting.UID = broker.UId
+	setting.PWD = broker.Pwd
+	setting.TimeOut = time.Duration(broker.TimeOut) * time.Second
+	setting.ReTry = broker.Retry
+	setting.LogMode = easyCon.ELogMode(broker.LogMode)
+	adapter, err := NewUpAdapter(broker, setting)
+	if err != nil {
+		return models.DeviceGrant{}, err
+	}
+	defer adapter.Stop()
+
+	resp := adapter.Req("Route", route, content)
+	if resp.RespCode != easyCon.ERespSuccess {
+		return models.DeviceGrant{}, errors.New(fmt.Sprintf("%v:%v %s", resp.RespCode, resp.Content, resp.Error))
+	}
+	grant := models.ToDeviceGrant(resp.Content)
+	if grant.DeviceId == "" {
+		return grant, errors.New("device id is nil")
+	}
+	return grant, nil
+}
+
+// IsProvisional 是否为尚未经根路由确认的临时设备码
+func IsProvisional() bool {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	return device.info.Provisional
+}
+
+// ConfirmDeviceId 根路由确认了设备码，如果根路由分配了新的设备码，保存为待生效并返回true，需重启后生效
+func ConfirmDeviceId(grant models.DeviceGrant) (bool, error) {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	id := grant.DeviceId
+	info := device.info
+	info.Provisional = false
+	info.Origin = "Confirmed"
+	if id != info.Id {
+		// 运行中仍使用原设备码和凭证，避免之后保存其他信息时覆盖新的设备码
+		fmt.Printf("[Provision]:device id changed to %s, restart to take effect\n", id)
+		info.Pending = &pendingCode{Id: id}
+		if grant.Credential != "" {
+			info.Pending.Credential = grant.Credential
+			info.Pending.CredentialTime = qdefine.NewDateTime(time.Now())
+		}
+		return true, device.update(info)
+	}
+	if grant.Credential != "" {
+		info.Credential = grant.Credential
+		info.CredentialTime = qdefine.NewDateTime(time.Now())
+	}
+	return false, device.update(info)
+}
+
+// update 保存到文件成功后再替换内存中的信息
+func (d *deviceCode) update(info codeInfo) error {
+	if err := d.saveToFile(info); err != nil {
+		return err
 	}
 	d.info = info
+	return nil
 }
 
-func (d *deviceCode) saveToFile(info qdefine.DeviceInfo) error {
-	// 写入文件
-	file := d.getCodeFile()
-	if file == "" {
+// saveToFile 先写入临时文件再替换，仅当前用户可读写
+func (d *deviceCode) saveToFile(info codeInfo) error {
+	if d.file == "" {
 		return errors.New("deviceCode file not find")
 	}
 	str, err := json.MarshalIndent(info, "", "  ")
 	if err != nil {
 		return err
 	}
-	err = qio.WriteAllBytes(file, str, false)
+	if err = os.MkdirAll(filepath.Dir(d.file), 0700); err != nil {
+		return err
+	}
+	tmp := d.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
+	if _, err = f.Write(str); err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, d.file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
 	return nil
 }
 
-func (d *deviceCode) getCodeFile() string {
-	root := qio.GetCurrentRoot()
+// 旧版本Linux下的设备码文件
+const legacyCodeFile = "/usr/qf/device"
+
+// codeFile 设备码文件位置，依次为环境变量、配置、系统默认位置
+func codeFile() (string, string) {
+	if file := os.Getenv("QF_DEVICE_FILE"); file != "" {
+		return file, "env QF_DEVICE_FILE"
+	}
+	if DeviceCode.File != "" {
+		return qio.GetFullPath(DeviceCode.File), "config"
+	}
 	switch runtime.GOOS {
 	case "windows":
-		return fmt.Sprintf("%s\\Program Files\\Qf\\device", root)
+		return fmt.Sprintf("%s\\Program Files\\Qf\\device", qio.GetCurrentRoot()), "default"
 	case "linux":
-		return "/usr/qf/device"
+		if os.Geteuid() == 0 {
+			return "/var/lib/qf/device", "default"
+		}
+		// 非root用户使用XDG状态目录
+		dir := os.Getenv("XDG_STATE_HOME")
+		if dir == "" {
+			home, _ := os.UserHomeDir()
+			dir = filepath.Join(home, ".local", "state")
+		}
+		return filepath.Join(dir, "qf", "device"), "default"
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", "default"
+	}
+	return filepath.Join(dir, "qf", "device"), "default"
+}
+
+// ShowIdentity 输出当前的设备码及其来源，不会申请新的设备码
+func ShowIdentity(module string) {
+	qconfig.Load(module+".deviceCode", &DeviceCode)
+	file, source := codeFile()
+	if !qio.PathExists(file) && source == "default" && qio.PathExists(legacyCodeFile) {
+		file, source = legacyCodeFile, "legacy "+legacyCodeFile
+	}
+	fmt.Printf("File:   %s (%s)\n", file, source)
+	str, err := qio.ReadAllString(file)
+	if err != nil {
+		fmt.Println("Id:     not provisioned")
+		return
+	}
+	info := codeInfo{}
+	if err = json.Unmarshal([]byte(str), &info); err != nil {
+		fmt.Printf("Id:     invalid file, %s\n", err.Error())
+		return
+	}
+	origin := info.Origin
+	if origin == "" {
+		origin = "unknown"
+	}
+	fmt.Printf("Id:     %s\n", info.Id)
+	fmt.Printf("Name:   %s\n", info.Name)
+	fmt.Printf("Origin: %s\n", origin)
+	if info.Provisional {
+		fmt.Println("State:  provisional, waiting for the root to confirm")
+	}
+	if info.Pending != nil {
+		fmt.Printf("Pending: %s, takes effect after restart\n", info.Pending.Id)
+	}
+	if info.Credential != "" {
+		fmt.Printf("Credential: issued at %s\n", info.CredentialTime.ToString())
 	}
-	return ""
 }
 
 func onStatus(adapter easyCon.IAdapter, status easyCon.EStatus) {
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"github.com/kamioair/qf/qdefine"
+	"github.com/kamioair/qf/qservice"
+	"path/filepath"
+	"router/inner/models"
+	"testing"
+)
+
+func TestConfirmDeviceIdPending(t *testing.T) {
+	tests := []struct {
+		name    string
+		grant   models.DeviceGrant
+		changed bool
+		wantId  string
+		wantCrd string
+	}{
+		{"same id", models.DeviceGrant{DeviceId: "old", Credential: "c1"}, false, "old", "c1"},
+		{"new id", models.DeviceGrant{DeviceId: "new", Credential: "c2"}, true, "new", "c2"},
+		{"new id without credential", models.DeviceGrant{DeviceId: "new"}, true, "new", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "device")
+			t.Setenv("QF_DEVICE_FILE", file)
+			device = deviceCode{file: file}
+			if err := device.update(codeInfo{DeviceInfo: qdefine.DeviceInfo{Id: "old", Name: "dev"}, Provisional: true, SignKey: newSignKey()}); err != nil {
+				t.Fatal(err)
+			}
+
+			changed, err := ConfirmDeviceId(tt.grant)
+			if err != nil || changed != tt.changed {
+				t.Fatalf("ConfirmDeviceId() = %v, %v, want %v", changed, err, tt.changed)
+			}
+			// 重启前仍使用原设备码，其他信息的保存不能覆盖新的设备码
+			if DeviceId() != "old" {
+				t.Errorf("DeviceId() = %s before restart, want old", DeviceId())
+			}
+			if err = SetDeviceName("renamed"); err != nil {
+				t.Fatal(err)
+			}
+
+			device = deviceCode{}
+			device.loadFromFile(qservice.EModeServer)
+			if DeviceId() != tt.wantId || DeviceName() != "renamed" || IsProvisional() {
+				t.Errorf("reload = %s %s provisional %v, want %s renamed", DeviceId(), DeviceName(), IsProvisional(), tt.wantId)
+			}
+			if cred, _ := DeviceCredential(); cred != tt.wantCrd {
+				t.Errorf("credential = %q, want %q", cred, tt.wantCrd)
+			}
+		})
+	}
+}
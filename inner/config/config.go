@@ -5,21 +5,66 @@ import (
 	"github.com/kamioair/qf/qdefine"
 	"github.com/kamioair/qf/qservice"
 	"github.com/kamioair/qf/utils/qconfig"
+	"github.com/kamioair/qf/utils/qio"
+	"path/filepath"
+	"sort"
 )
 
 // Mode 服务模式
 var Mode qservice.EServerMode
 
+// BrokerTls 连接Broker的TLS配置，地址为ssl://、tls://、mqtts://或wss://时启用
+type BrokerTls struct {
+	CaFile     string // CA证书，为空使用系统证书
+	CertFile   string // 客户端证书，双向认证时填写
+	KeyFile    string // 客户端私钥
+	ServerName string // 校验的服务端名称，为空使用地址中的主机名
+	MinVersion string // 最低版本：1.2、1.3
+	WarnDays   int    // 证书到期前多少天开始报警
+}
+
+// UpBroker 向上路由Broker配置
+type UpBroker struct {
+	qdefine.BrokerConfig
+	Tls      BrokerTls
+	Priority int // 优先级，越小越优先
+}
+
 // UpMqtt 向上路由配置
-var UpMqtt = qdefine.BrokerConfig{
-	Addr:    "",
-	UId:     "",
-	Pwd:     "",
-	LogMode: "NONE",
-	TimeOut: 3000,
-	Retry:   3,
+var UpMqtt = UpBroker{
+	BrokerConfig: qdefine.BrokerConfig{
+		Addr:    "",
+		UId:     "",
+		Pwd:     "",
+		LogMode: "NONE",
+		TimeOut: 3000,
+		Retry:   3,
+	},
+	Tls: BrokerTls{
+		MinVersion: "1.2",
+		WarnDays:   30,
+	},
+}
+
+// Uplinks 备用的上级Broker，与UpMqtt一起按优先级选择，未填写的连接参数沿用UpMqtt
+var Uplinks = make([]UpBroker, 0)
+
+// Failover 上级Broker故障切换配置
+var Failover = struct {
+	CheckInterval    int // 健康检查间隔（秒）
+	MaxFails         int // 连续失败多少次后切换
+	FailbackInterval int // 使用备用Broker时，检查更优先Broker的间隔（秒）
+	DownAlarm        int // 上级断开多少秒后报警UplinkDown
+}{
+	CheckInterval:    10,
+	MaxFails:         3,
+	FailbackInterval: 60,
+	DownAlarm:        30,
 }
 
+// LocalMqtt 本地Broker配置，与微服务使用同一个Broker
+var LocalMqtt qdefine.BrokerConfig
+
 // Monitor 监控配置
 var Monitor = struct {
 	Cron      string   // 检测间隔
@@ -39,11 +84,292 @@ var Monitor = struct {
 	Processes: []string{},
 }
 
-func Init(module string, mode qservice.EServerMode) {
+// Queue 上行离线缓存配置
+var Queue = struct {
+	File     string // 缓存日志文件，每行一条Json，相对路径以程序目录为准
+	MaxCount int    // 最大缓存条数，超出后丢弃最早的
+	MaxAge   int    // 最长缓存时间（秒），超时后丢弃
+}{
+	File:     "./data/outbox.json",
+	MaxCount: 10000,
+	MaxAge:   7 * 24 * 3600,
+}
+
+// Trace 请求追踪配置
+var Trace = struct {
+	Export   string // 导出方式：空为不导出，file为写入文件，otlp为发送到采集器
+	File     string // 导出文件，OTLP/JSON格式，每行一批
+	Endpoint string // 采集器地址，OTLP/HTTP的JSON接口
+	Interval int    // 导出间隔（秒）
+}{
+	Export:   "",
+	File:     "./log/trace.json",
+	Endpoint: "http://127.0.0.1:4318/v1/traces",
+	Interval: 5,
+}
+
+// Offline 离线设备请求配置
+var Offline = struct {
+	QueueMax    int // 每个离线设备最多排队的请求数
+	QueueMaxAge int // 排队请求的最长等待时间（秒）
+}{
+	QueueMax:    100,
+	QueueMaxAge: 3600,
+}
+
+// Stream 路由间分块传输配置
+var Stream = struct {
+	Dir          string // 接收缓存目录
+	ChunkSize    int    // 分块大小（字节）
+	Window       int    // 同时在途的块数量
+	RetryTimeout int    // 断线后续传的最长等待时间（秒）
+	MaxSize      int64  // 接收的单个流最大大小（字节），为0时只受磁盘可用空间限制
+}{
+	Dir:          "./data/streams",
+	ChunkSize:    256 * 1024,
+	Window:       4,
+	RetryTimeout: 600,
+	MaxSize:      0,
+}
+
+// Files 设备间文件传输配置
+var Files = struct {
+	Root string // 沙箱根目录，推送和拉取的文件均限制在该目录下
+}{
+	Root: "./data/files",
+}
+
+// ExecCommand 允许远程执行的命令
+type ExecCommand struct {
+	Path      string   // 可执行文件
+	Args      []string // 固定参数
+	Dir       string   // 工作目录，请求指定的目录需在此目录之内
+	AllowArgs bool     // 是否允许请求附加参数
+}
+
+// Exec 远程命令配置
+var Exec = struct {
+	Commands  map[string]ExecCommand // 允许执行的命令，key为命令名称
+	Timeout   int                    // 默认及最大超时时间（秒）
+	MaxOutput int                    // 标准输出和错误输出各自的最大字节数
+}{
+	Commands:  map[string]ExecCommand{},
+	Timeout:   60,
+	MaxOutput: 64 * 1024,
+}
+
+// Audit 审计配置
+var Audit = struct {
+	File string // 根路由的审计日志文件
+}{
+	File: "./log/audit.log",
+}
+
+// Logs 模块日志配置
+var Logs = struct {
+	Paths    []string // 模块日志目录，{module}会替换为模块名称
+	MaxLines int      // 单次读取的最大行数
+}{
+	Paths:    []string{"../{module}/log"},
+	MaxLines: 1000,
+}
+
+// Modules 模块生命周期配置
+var Modules = struct {
+	StaleTimeout  int // 超过该时间（秒）未敲门且探测无响应视为失联，0为不检测
+	CrashTimeout  int // 失联超过该时间（秒）视为崩溃
+	DowngradeKeep int // 版本降级后报警的持续时间（小时），稳定运行超过该时间后不再报警，0为一直报警
+}{
+	StaleTimeout:  60,
+	CrashTimeout:  180,
+	DowngradeKeep: 24,
+}
+
+// Inventory 模块版本清单配置
+var Inventory = struct {
+	Expected map[string]string // 期望的模块版本，key为模块名称，不一致时报版本漂移
+}{
+	Expected: map[string]string{},
+}
+
+// ControlService 可远程控制的模块服务
+type ControlService struct {
+	Unit string   // systemd服务名称，为空时使用模块名称
+	Path string   // 可执行文件，process方式使用
+	Args []string // 启动参数，process方式使用
+	Dir  string   // 工作目录，process方式使用
+}
+
+// Control 模块启停配置
+var Control = struct {
+	Backend string                    // 服务管理方式：systemd，或process由路由自己启动进程
+	Modules map[string]ControlService // 允许控制的模块，key为模块名称
+	Timeout int                       // 操作超时时间（秒）
+}{
+	Backend: "process",
+	Modules: map[string]ControlService{},
+	Timeout: 30,
+}
+
+// UpdateTarget 允许在线更新的模块
+type UpdateTarget struct {
+	Path string // 模块可执行文件，更新时整体替换
+}
+
+// Update 模块在线更新配置
+var Update = struct {
+	Modules   map[string]UpdateTarget // 允许更新的模块，key为模块名称，启停使用control配置
+	BackupDir string                  // 旧版本备份目录，用于回滚
+}{
+	Modules:   map[string]UpdateTarget{},
+	BackupDir: "./data/backup",
+}
+
+// DeviceCode 设备码文件配置
+var DeviceCode = struct {
+	File string // 设备码文件，为空使用系统默认位置，环境变量QF_DEVICE_FILE优先
+}{
+	File: "",
+}
+
+// Provision 设备码申请配置
+var Provision = struct {
+	Name       string // 申请登记时的设备名称，为空使用主机名
+	Timeout    int    // 启动时等待上级分配设备码的最长时间（秒），超时后使用本地临时设备码
+	MaxBackoff int    // 重试间隔上限（秒）
+}{
+	Name:       "",
+	Timeout:    60,
+	MaxBackoff: 30,
+}
+
+// Enroll 设备登记审批配置，仅根路由使用
+var Enroll = struct {
+	Enabled bool   // 是否需要审批，开启后未审批的设备无法获取设备码、敲门和心跳，开启前已登记的设备自动审批通过
+	File    string // 登记申请保存文件
+}{
+	Enabled: false,
+	File:    "./data/enroll.json",
+}
+
+// Identity 设备硬件信息登记配置，仅根路由使用
+var Identity = struct {
+	File string // 已分配设备码的硬件信息保存文件
+}{
+	File: "./data/identity.json",
+}
+
+// Credential 设备凭证配置
+var Credential = struct {
+	Enabled    bool   // 根路由是否给每个设备签发独立凭证
+	File       string // 根路由保存已签发凭证的文件
+	RotateDays int    // 设备凭证的更换周期（天），0为不更换
+	BrokerAuth bool   // 连接上级Broker时使用设备码和凭证代替共享的用户名密码，需Broker按VerifyCredential校验
+}{
+	Enabled:    false,
+	File:       "./data/credentials.json",
+	RotateDays: 30,
+	BrokerAuth: false,
+}
+
+// Sign 心跳和敲门签名配置
+var Sign = struct {
+	Enabled  bool   // 向上级发送的心跳、敲门和审计记录是否签名，未签名的审计记录不会被上级接受
+	Required bool   // 是否拒绝下级路由未签名的心跳和敲门，本机模块的敲门除外
+	MaxSkew  int    // 签名时间允许的最大偏差（秒），超出视为重放
+	File     string // 根路由保存设备公钥的文件
+}{
+	Enabled:  false,
+	Required: false,
+	MaxSkew:  300,
+	File:     "./data/keys.json",
+}
+
+// Tags 设备标签，如site、line、role、customer
+var Tags = map[string]string{}
+
+func Init(module string, mode qservice.EServerMode, broker qdefine.BrokerConfig) {
 	qconfig.Load(module+".upMqtt", &UpMqtt)
+	qconfig.Load(module+".uplinks", &Uplinks)
+	qconfig.Load(module+".failover", &Failover)
 	qconfig.Load("monitor", &Monitor)
+	qconfig.Load(module+".queue", &Queue)
+	qconfig.Load(module+".trace", &Trace)
+	qconfig.Load(module+".offline", &Offline)
+	qconfig.Load(module+".stream", &Stream)
+	qconfig.Load(module+".files", &Files)
+	qconfig.Load(module+".exec", &Exec)
+	qconfig.Load(module+".audit", &Audit)
+	qconfig.Load(module+".logs", &Logs)
+	qconfig.Load(module+".modules", &Modules)
+	qconfig.Load(module+".inventory", &Inventory)
+	qconfig.Load(module+".control", &Control)
+	qconfig.Load(module+".update", &Update)
+	qconfig.Load(module+".tags", &Tags)
+	qconfig.Load(module+".deviceCode", &DeviceCode)
+	qconfig.Load(module+".provision", &Provision)
+	qconfig.Load(module+".enroll", &Enroll)
+	qconfig.Load(module+".identity", &Identity)
+	qconfig.Load(module+".credential", &Credential)
+	qconfig.Load(module+".sign", &Sign)
+	// 数据文件的相对路径按程序目录处理，避免从其他目录启动时找不到已保存的数据
+	Queue.File = programPath(Queue.File)
+	Trace.File = programPath(Trace.File)
+	Stream.Dir = programPath(Stream.Dir)
+	Files.Root = programPath(Files.Root)
+	Audit.File = programPath(Audit.File)
+	Update.BackupDir = programPath(Update.BackupDir)
+	Enroll.File = programPath(Enroll.File)
+	Identity.File = programPath(Identity.File)
+	Credential.File = programPath(Credential.File)
+	Sign.File = programPath(Sign.File)
+	for i, p := range Logs.Paths {
+		Logs.Paths[i] = programPath(p)
+	}
 	Mode = mode
+	LocalMqtt = broker
 
 	// 加载设备ID
 	device.loadFromFile(mode)
 }
+
+// UpBrokers 所有上级Broker，按优先级排序，没有配置时为空
+func UpBrokers() []UpBroker {
+	list := make([]UpBroker, 0)
+	if UpMqtt.Addr != "" {
+		list = append(list, UpMqtt)
+	}
+	for _, b := range Uplinks {
+		if b.Addr == "" {
+			continue
+		}
+		if b.UId == "" && b.Pwd == "" {
+			b.UId, b.Pwd = UpMqtt.UId, UpMqtt.Pwd
+		}
+		if b.LogMode == "" {
+			b.LogMode = UpMqtt.LogMode
+		}
+		if b.TimeOut == 0 {
+			b.TimeOut = UpMqtt.TimeOut
+		}
+		if b.Retry == 0 {
+			b.Retry = UpMqtt.Retry
+		}
+		if b.Tls == (BrokerTls{}) {
+			b.Tls = UpMqtt.Tls
+		}
+		list = append(list, b)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Priority < list[j].Priority
+	})
+	return list
+}
+
+// programPath 相对路径按程序所在目录解析，不受启动时的工作目录影响
+func programPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(qio.GetCurrentDirectory(), path)
+}
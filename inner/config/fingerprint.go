@@ -0,0 +1,109 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/kamioair/qf/utils/qio"
+	"net"
+	"os"
+	"router/inner/models"
+	"sort"
+	"strings"
+)
+
+// NewEnrollRequest 生成本机的登记申请
+func NewEnrollRequest(devId string) models.EnrollRequest {
+	host, _ := os.Hostname()
+	name := Provision.Name
+	if name == "" {
+		name = host
+	}
+	hw := hardware()
+	cred := ""
+	if devId != "" {
+		cred, _ = DeviceCredential()
+	}
+	return models.EnrollRequest{
+		DeviceId:    devId,
+		PublicKey:   PublicKey(),
+		Hostname:    host,
+		Fingerprint: fingerprint(hw),
+		Hardware:    hw,
+		Name:        name,
+		Credential:  cred,
+	}
+}
+
+// fingerprint 根据硬件信息生成指纹
+func fingerprint(hw models.Hardware) string {
+	items := make([]string, 0)
+	if hw.MachineId != "" {
+		items = append(items, hw.MachineId)
+	}
+	if hw.Serial != "" {
+		items = append(items, hw.Serial)
+	}
+	items = append(items, hw.Macs...)
+	if len(items) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(items, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// hardware 读取机器码、网卡地址和主板序列号
+func hardware() models.Hardware {
+	return models.Hardware{
+		MachineId: readFirst("/etc/machine-id", "/var/lib/dbus/machine-id"),
+		Macs:      macAddrs(),
+		Serial:    serial(),
+	}
+}
+
+// serial 主板序列号，厂商未填写的占位值视为没有
+func serial() string {
+	for _, file := range []string{"/sys/class/dmi/id/board_serial", "/sys/class/dmi/id/product_serial"} {
+		if str := readFirst(file); models.ValidSerial(str) {
+			return str
+		}
+	}
+	return ""
+}
+
+func readFirst(files ...string) string {
+	for _, file := range files {
+		if str, err := qio.ReadAllString(file); err == nil && strings.TrimSpace(str) != "" {
+			return strings.TrimSpace(str)
+		}
+	}
+	return ""
+}
+
+// macAddrs 物理网卡地址，排序后返回
+func macAddrs() []string {
+	list := make([]string, 0)
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return list
+	}
+	for _, i := range ifs {
+		if i.Flags&net.FlagLoopback != 0 || virtualIf(i.Name) || !models.PhysicalMac(i.HardwareAddr.String()) {
+			continue
+		}
+		list = append(list, i.HardwareAddr.String())
+	}
+	sort.Strings(list)
+	return list
+}
+
+// 容器、虚拟机和隧道创建的网卡，地址会在多台设备上重复或随时变化
+var virtualIfPrefixes = []string{"docker", "veth", "br-", "virbr", "vmnet", "vboxnet", "tun", "tap", "cni", "flannel", "cali", "vxlan", "wg", "zt"}
+
+func virtualIf(name string) bool {
+	for _, p := range virtualIfPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"router/inner/models"
+	"time"
+)
+
+// PublicKey 本机的签名公钥，base64
+func PublicKey() string {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	return publicKey(device.info.SignKey)
+}
+
+// SignMessage 用本机私钥签名发送给上级的消息
+func SignMessage(route string, content any) (models.SignedMessage, error) {
+	device.lock.Lock()
+	key := device.info.SignKey
+	device.lock.Unlock()
+
+	seed, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return models.SignedMessage{}, errors.New("sign key is invalid")
+	}
+	body, err := json.Marshal(content)
+	if err != nil {
+		return models.SignedMessage{}, err
+	}
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return models.SignedMessage{}, err
+	}
+	msg := models.SignedMessage{
+		Id:    DeviceId(),
+		Route: route,
+		Time:  time.Now().UnixMilli(),
+		Nonce: hex.EncodeToString(nonce),
+		Body:  string(body),
+	}
+	sig := ed25519.Sign(ed25519.NewKeyFromSeed(seed), msg.Payload())
+	msg.Sig = base64.StdEncoding.EncodeToString(sig)
+	return msg, nil
+}
+
+// newSignKey 生成签名私钥，保存种子
+func newSignKey() string {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(seed)
+}
+
+func publicKey(key string) string {
+	seed, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return ""
+	}
+	pub := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	return base64.StdEncoding.EncodeToString(pub)
+}
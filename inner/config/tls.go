@@ -0,0 +1,160 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upTls 连接上级Broker的TLS信息，由MQTT客户端直接建立TLS连接
+type upTls struct {
+	target     string // 上级Broker的host:port
+	conf       BrokerTls
+	peerExpiry time.Time // 上级服务端证书的到期时间，握手后更新
+}
+
+var tlsLock sync.Mutex
+var upTlses = map[string]*upTls{} // key为上级Broker地址
+
+// 安全协议对应的默认端口
+var tlsSchemes = map[string]string{
+	"ssl":      "8883",
+	"tls":      "8883",
+	"mqtts":    "8883",
+	"mqtt+ssl": "8883",
+	"tcps":     "8883",
+	"wss":      "443",
+}
+
+// TlsConfig 连接上级Broker使用的TLS配置，非安全协议返回nil
+func TlsConfig(broker UpBroker) (*tls.Config, error) {
+	u, err := url.Parse(broker.Addr)
+	if err != nil || broker.Addr == "" {
+		return nil, err
+	}
+	port, ok := tlsSchemes[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, nil
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	tlsLock.Lock()
+	t, ok := upTlses[broker.Addr]
+	if !ok {
+		t = &upTls{target: net.JoinHostPort(u.Hostname(), port)}
+		upTlses[broker.Addr] = t
+	}
+	t.conf = broker.Tls
+	tlsLock.Unlock()
+	return t.newTlsConfig(u.Hostname())
+}
+
+// UpCertAlarm 上级连接的证书到期报警内容，没有即将到期的证书返回空
+func UpCertAlarm() string {
+	tlsLock.Lock()
+	list := make([]upTls, 0)
+	for _, t := range upTlses {
+		list = append(list, *t)
+	}
+	tlsLock.Unlock()
+
+	alarm := ""
+	for _, t := range list {
+		if t.conf.CertFile != "" {
+			expiry, err := certExpiry(t.conf)
+			if err != nil {
+				alarm += fmt.Sprintf("%s client cert %s\n", t.target, err.Error())
+			} else {
+				alarm += expiryAlarm(t.target+" client", expiry, t.conf.WarnDays)
+			}
+		}
+		if !t.peerExpiry.IsZero() {
+			alarm += expiryAlarm(t.target+" server", t.peerExpiry, t.conf.WarnDays)
+		}
+	}
+	return strings.Trim(alarm, "\n")
+}
+
+func expiryAlarm(name string, expiry time.Time, days int) string {
+	if days <= 0 {
+		days = 30
+	}
+	if time.Now().After(expiry) {
+		return fmt.Sprintf("%s cert expired at %s\n", name, expiry.Local().Format("2006-01-02 15:04"))
+	}
+	if time.Now().Add(time.Duration(days) * 24 * time.Hour).After(expiry) {
+		return fmt.Sprintf("%s cert expires at %s\n", name, expiry.Local().Format("2006-01-02 15:04"))
+	}
+	return ""
+}
+
+func (t *upTls) newTlsConfig(host string) (*tls.Config, error) {
+	c := t.conf
+	conf := &tls.Config{
+		ServerName: host,
+	}
+	if c.ServerName != "" {
+		conf.ServerName = c.ServerName
+	}
+	switch c.MinVersion {
+	case "", "1.2":
+		conf.MinVersion = tls.VersionTLS12
+	case "1.3":
+		conf.MinVersion = tls.VersionTLS13
+	default:
+		return nil, errors.New(fmt.Sprintf("tls min version %s is not supported", c.MinVersion))
+	}
+	if c.CaFile != "" {
+		pem, err := os.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("ca file %s has no certificate", c.CaFile))
+		}
+	}
+	if c.CertFile != "" {
+		// 先校验一次，握手时重新读取，证书更换后无需重启
+		if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			return nil, err
+		}
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) > 0 {
+			tlsLock.Lock()
+			t.peerExpiry = cs.PeerCertificates[0].NotAfter
+			tlsLock.Unlock()
+		}
+		return nil
+	}
+	return conf, nil
+}
+
+func certExpiry(c BrokerTls) (time.Time, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return leaf.NotAfter, nil
+}
@@ -6,6 +6,8 @@ type Device struct {
 	qdefine.DbFull
 	Code    string `gorm:"unique"` // 设备码
 	Name    string // 设备名称
+	Desc    string // 设备描述
 	Parent  string // 父级设备码
 	Modules string // 包含的模块列表 Json
+	Tags    string // 设备标签 Json
 }
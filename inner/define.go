@@ -44,6 +44,15 @@ func onInit(moduleName string) {
 	initFinish = true
 }
 
+// 处理外部请求，路由错误以Json格式返回，便于请求方的路由还原
+func onReq(route string, ctx qdefine.Context) (any, error) {
+	rs, err := onReqHandler(route, ctx)
+	if err != nil {
+		return nil, errors.New(models.ErrorContent(err))
+	}
+	return rs, nil
+}
+
 // 处理外部请求
 func onReqHandler(route string, ctx qdefine.Context) (any, error) {
 	switch route {
@@ -51,15 +60,28 @@ func onReqHandler(route string, ctx qdefine.Context) (any, error) {
 	//-------------------------------------------
 	//  以下由基于Qf框架的模块发送请求
 	case "KnockDoor": // 模块敲门
+		doors := map[string]models.DeviceKnock{}
+		signer, err := routeBll.Unseal(route, ctx.Raw(), &doors)
+		if err != nil {
+			return nil, err
+		}
+		return routeBll.KnockDoor(signer, doors)
+	case "LeaveDoor": // 模块退出
 		doors := qconvert.ToAny[map[string]models.DeviceKnock](ctx.Raw())
-		return routeBll.KnockDoor(doors)
+		return routeBll.LeaveDoor(doors)
 	case "Request": // 跨路由请求
 		model := qconvert.ToAny[models.RouteInfo](ctx.Raw())
 		return routeBll.Request(model)
+	case "Post": // 跨路由请求，不等待结果，上行不通时离线缓存
+		model := qconvert.ToAny[models.RouteInfo](ctx.Raw())
+		return routeBll.Post(model)
 	case "CustomAlarm": // 模块的自定义警报
 		alarmType := ctx.GetString("type")
 		alarmValue := ctx.GetString("value")
 		return routeBll.AddAlarm(alarmType, alarmValue)
+	case "SubscribeNotice": // 订阅其他路由下模块的通知
+		info := qconvert.ToAny[models.NoticeInterest](ctx.Raw())
+		return routeBll.SubscribeNotice(info)
 
 	//-------------------------------------------
 	//  以下仅由路由模块向上层路由模块发送请求
@@ -68,27 +90,132 @@ func onReqHandler(route string, ctx qdefine.Context) (any, error) {
 	case "GetDeviceCache": // 请求服务器设备信息
 		return routeBll.GetDeviceCache()
 	case "NewDeviceId": // 申请一个新的Id
-		return routeBll.NewDeviceId()
+		req := qconvert.ToAny[models.EnrollRequest](ctx.Raw())
+		return routeBll.NewDeviceId(req)
+	case "ConfirmDeviceId": // 确认本地生成的临时设备码
+		req := qconvert.ToAny[models.EnrollRequest](ctx.Raw())
+		return routeBll.ConfirmDeviceId(req)
+	case "RotateCredential": // 更换设备凭证
+		req := qconvert.ToAny[models.CredentialCheck](ctx.Raw())
+		return routeBll.RotateCredential(req)
+	case "RegisterKey": // 登记设备签名公钥
+		req := qconvert.ToAny[models.DeviceKey](ctx.Raw())
+		return routeBll.RegisterKey(req)
+	case "GetDeviceKey": // 获取设备签名公钥
+		return routeBll.GetDeviceKey(ctx.GetString("id"))
+	case "VerifyCredential": // 校验设备凭证
+		req := qconvert.ToAny[models.CredentialCheck](ctx.Raw())
+		return routeBll.VerifyCredential(req)
 	case "Heart": // 发送心跳
-		alarm := qconvert.ToAny[struct {
-			Id   string
-			Info map[string]models.DeviceAlarm
-		}](ctx.Raw())
-		routeBll.AddHeart(alarm.Id, alarm.Info)
+		alarm := struct {
+			Id       string
+			Instance models.DeviceInstance
+			Info     map[string]models.DeviceAlarm
+		}{}
+		signer, err := routeBll.Unseal(route, ctx.Raw(), &alarm)
+		if err != nil {
+			return nil, err
+		}
+		if err = routeBll.AddHeart(signer, alarm.Id, alarm.Instance, alarm.Info); err != nil {
+			return nil, err
+		}
 		return true, nil
+	case "ForwardNotice": // 下级路由转发的通知
+		fw := qconvert.ToAny[models.NoticeForward](ctx.Raw())
+		return routeBll.ForwardNotice(fw)
+
+	//-------------------------------------------
+	//  以下由其他路由模块经过路由请求发送的分块传输
+	case "StreamOpen": // 打开数据流
+		open := qconvert.ToAny[models.StreamOpen](ctx.Raw())
+		return routeBll.StreamOpen(open)
+	case "StreamChunk": // 写入数据块
+		chunk := qconvert.ToAny[models.StreamChunk](ctx.Raw())
+		return routeBll.StreamChunk(chunk)
+	case "StreamClose": // 关闭数据流
+		c := qconvert.ToAny[models.StreamClose](ctx.Raw())
+		return routeBll.StreamClose(c)
+	case "AuditLog": // 下级路由上报的审计记录，需签名
+		rec := models.AuditRecord{}
+		signer, err := routeBll.Unseal(route, ctx.Raw(), &rec)
+		if err != nil {
+			return nil, err
+		}
+		return routeBll.AuditLog(signer, rec)
 
 	//-------------------------------------------
 	//  以下由前端管理页面发送请求
 	case "AlarmDeviceList": // 仅获取所有报警设备列表
-		return routeBll.GetDeviceAlarm()
+		filter := qconvert.ToAny[models.DeviceFilter](ctx.Raw())
+		return routeBll.GetDeviceAlarm(filter)
 	case "AllDeviceList": // 获取所有设备列表
-		return routeBll.GetDeviceList()
+		filter := qconvert.ToAny[models.DeviceFilter](ctx.Raw())
+		return routeBll.GetDeviceList(filter)
+	case "SetDeviceName": // 修改目标设备的名称
+		info := qconvert.ToAny[models.DeviceProfile](ctx.Raw())
+		return routeBll.SetDeviceName(info)
+	case "SetDeviceDescription": // 修改目标设备的描述
+		info := qconvert.ToAny[models.DeviceProfile](ctx.Raw())
+		return routeBll.SetDeviceDescription(info)
+	case "SetDeviceTags": // 编辑目标设备的标签
+		info := qconvert.ToAny[models.DeviceTags](ctx.Raw())
+		return routeBll.SetDeviceTags(info)
+	case "Broadcast": // 按筛选条件向多个设备发送请求
+		req := qconvert.ToAny[models.BroadcastRequest](ctx.Raw())
+		return routeBll.Broadcast(req)
 	case "GetDeviceDetail": // 获取当前设备的详细信息
 		return routeBll.GetDeviceDetail()
+	case "PendingDevices": // 获取设备登记申请
+		return routeBll.PendingDevices()
+	case "ApproveDevice": // 审批通过设备登记申请
+		return routeBll.ApproveDevice(ctx.GetString("id"))
+	case "RejectDevice": // 拒绝设备登记申请
+		return routeBll.RejectDevice(ctx.GetString("id"))
+	case "RemoveDevice": // 移除设备并吊销设备凭证
+		return routeBll.RemoveDevice(ctx.GetString("id"))
+	case "ReprovisionDevice": // 让目标设备重新申请设备码
+		req := qconvert.ToAny[models.Reprovision](ctx.Raw())
+		return routeBll.ReprovisionDevice(req)
+	case "IdentityConflicts": // 获取硬件信息冲突报告
+		return routeBll.IdentityConflicts()
+	case "ModuleInventory": // 获取所有设备的模块版本清单
+		return routeBll.ModuleInventory()
+	case "GetQueueState": // 获取上行离线缓存状态
+		return routeBll.GetQueueState()
+	case "SendStream": // 发送通用数据流到目标设备
+		req := qconvert.ToAny[models.StreamSend](ctx.Raw())
+		return routeBll.SendStream(req)
+	case "PushFile": // 推送文件到目标设备
+		info := qconvert.ToAny[models.FileTransfer](ctx.Raw())
+		return routeBll.PushFile(info)
+	case "PullFile": // 从目标设备拉取文件
+		info := qconvert.ToAny[models.FileTransfer](ctx.Raw())
+		return routeBll.PullFile(info)
+	case "Exec": // 在目标设备执行允许列表中的命令
+		req := qconvert.ToAny[models.ExecRequest](ctx.Raw())
+		return routeBll.Exec(req)
+	case "ModuleControl": // 启动、停止或重启目标设备上的模块
+		req := qconvert.ToAny[models.ModuleControl](ctx.Raw())
+		return routeBll.ModuleControl(req)
+	case "CreateRollout": // 创建模块分批更新
+		plan := qconvert.ToAny[models.RolloutPlan](ctx.Raw())
+		return routeBll.CreateRollout(plan)
+	case "GetRollouts": // 获取分批更新状态
+		return routeBll.GetRollouts()
+	case "GetStreams": // 获取数据流传输状态
+		return routeBll.GetStreams()
+	case "ListLogs": // 列出本机模块的日志文件
+		query := qconvert.ToAny[models.LogQuery](ctx.Raw())
+		return routeBll.ListLogs(query.Module)
+	case "TailLog": // 读取本机模块日志的最后几行
+		query := qconvert.ToAny[models.LogQuery](ctx.Raw())
+		return routeBll.TailLog(query)
 	case "Ping": // 反向ping测试
 		return fmt.Println("[Ping]:", "OK")
+	case "Health": // 上级Broker健康检查，不输出日志
+		return true, nil
 	}
-	return nil, errors.New("route Not Matched")
+	return nil, models.NewRouteError(models.ERouteErrNotFound, config.DeviceId(), "route Not Matched")
 }
 
 // 处理外部通知
@@ -107,6 +234,8 @@ func onStatusHandler(route string, ctx qdefine.Context) {
 func onCommStateHandler(state qdefine.ECommState) {
 	if state == qdefine.ECommStateLinked {
 		if initFinish {
+			// 重发断线期间的离线缓存
+			go routeBll.FlushQueue()
 			go func() {
 				time.Sleep(time.Second * 5)
 				routeBll.ReKnockDoor()
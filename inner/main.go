@@ -2,18 +2,28 @@ package main
 
 import (
 	"github.com/kamioair/qf/qservice"
+	"github.com/kamioair/qf/utils/qconfig"
+	"github.com/kamioair/qf/utils/qio"
+	"os"
+	"path/filepath"
 	"router/inner/config"
 )
 
 func main() {
+	// 查看设备码，不启动服务
+	if len(os.Args) > 1 && os.Args[1] == "ShowIdentity" {
+		showIdentity()
+		return
+	}
+
 	setting := qservice.NewSetting(DefModule, DefDesc, Version).
 		BindInitFunc(onInit).
-		BindReqFunc(onReqHandler).
+		BindReqFunc(onReq).
 		BindNoticeFunc(onNoticeHandler).
 		BindCommStateFunc(onCommStateHandler)
 
 	// 配置初始化
-	config.Init(setting.Module, setting.Mode)
+	config.Init(setting.Module, setting.Mode, setting.Broker)
 
 	// 设置设备ID
 	setting.DevCode = config.DeviceId()
@@ -22,3 +32,13 @@ func main() {
 	service = qservice.NewService(setting)
 	service.Run()
 }
+
+func showIdentity() {
+	if exe, err := os.Executable(); err == nil {
+		_ = os.Chdir(filepath.Dir(exe))
+	}
+	if qio.PathExists("./config/config.yaml") {
+		qconfig.ChangeFilePath("./config/config.yaml")
+	}
+	config.ShowIdentity(DefModule)
+}
@@ -1,27 +1,232 @@
 package models
 
-import "sort"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kamioair/qf/qdefine"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // DeviceKnock 设备敲门信息
 type DeviceKnock struct {
-	Id      string           // 设备码
-	Name    string           // 设备名称
-	FullUrl string           // 完整路径
-	Modules ModuleCollection // 包含的模块列表
+	Id      string            // 设备码
+	Name    string            // 设备名称
+	Desc    string            // 设备描述
+	FullUrl string            // 完整路径
+	Tags    map[string]string // 设备标签
+	Modules ModuleCollection  // 包含的模块列表
 }
 
 // DeviceInfo 完整设备信息
 type DeviceInfo struct {
-	Id       string           // 设备码
-	Name     string           // 设备名称
-	FullUrl  string           // 完整路径
-	Parent   string           // 父级名称
-	IsOnline bool             // 网络是否在线
-	Cpu      CpuMemState      // CPU
-	Memory   CpuMemState      // 内存
-	Disk     []DiskState      // 磁盘
-	Process  []ProcessState   // 进程
-	Modules  ModuleCollection // 包含的模块列表
+	Id       string            // 设备码
+	Name     string            // 设备名称
+	Desc     string            // 设备描述
+	FullUrl  string            // 完整路径
+	Parent   string            // 父级名称
+	Tags     map[string]string // 设备标签
+	IsOnline bool              // 网络是否在线
+	Cpu      CpuMemState       // CPU
+	Memory   CpuMemState       // 内存
+	Disk     []DiskState       // 磁盘
+	Process  []ProcessState    // 进程
+	Modules  ModuleCollection  // 包含的模块列表
+}
+
+// DeviceFilter 设备筛选条件
+type DeviceFilter struct {
+	Prefix string            // 设备完整路径前缀，按层级匹配
+	Tags   map[string]string // 需全部匹配的标签
+}
+
+// Match 是否满足筛选条件
+func (f DeviceFilter) Match(fullUrl string, tags map[string]string) bool {
+	prefix := strings.Trim(f.Prefix, "/")
+	if prefix != "" && fullUrl != prefix && !strings.HasPrefix(fullUrl, prefix+"/") {
+		return false
+	}
+	for k, v := range f.Tags {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// EnrollRequest 设备登记申请
+type EnrollRequest struct {
+	Id          string           // 申请唯一号，由根路由分配
+	PublicKey   string           // 设备签名公钥
+	DeviceId    string           // 设备码，审批通过后分配，设备使用临时设备码时为临时码
+	Hostname    string           // 主机名
+	Fingerprint string           // 硬件指纹
+	Hardware    Hardware         // 硬件信息
+	Name        string           // 申请的设备名称
+	Credential  string           // 设备当前的凭证，申请已有凭证的设备码时校验，不保存
+	Status      string           // 状态：Pending、Approved、Rejected
+	Time        qdefine.DateTime // 最后申请时间
+}
+
+// Hardware 设备硬件信息，用于识别重装后的设备
+type Hardware struct {
+	MachineId string   // 系统机器码
+	Macs      []string // 物理网卡地址
+	Serial    string   // 主板序列号
+}
+
+// 厂商未填写时的主板序列号，多台设备相同，不能用于识别
+var placeholderSerials = []string{
+	"none", "n/a", "na", "default string", "not specified", "not applicable",
+	"to be filled by o.e.m.", "system serial number", "0123456789", "123456789",
+}
+
+// ValidSerial 主板序列号是否可用于识别设备
+func ValidSerial(serial string) bool {
+	serial = strings.ToLower(strings.TrimSpace(serial))
+	for _, p := range placeholderSerials {
+		if serial == p {
+			return false
+		}
+	}
+	return strings.Trim(serial, "0") != ""
+}
+
+// PhysicalMac 是否为出厂烧录的网卡地址，本地管理的地址多为虚拟网卡或随机生成
+func PhysicalMac(mac string) bool {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) == 0 {
+		return false
+	}
+	return hw[0]&0x02 == 0 && strings.Trim(hw.String(), "0:") != ""
+}
+
+// IdentityRecord 根路由分配设备码时记录的硬件信息
+type IdentityRecord struct {
+	DeviceId string           // 设备码
+	Hardware Hardware         // 硬件信息
+	Time     qdefine.DateTime // 最后登记时间
+}
+
+// IdentityConflict 硬件信息冲突报告
+type IdentityConflict struct {
+	Time      qdefine.DateTime // 时间
+	Hardware  Hardware         // 申请的硬件信息
+	DeviceIds []string         // 匹配到的设备码
+	Reason    string           // 冲突原因
+}
+
+// DeviceInstance 设备运行实例，每次启动生成新的实例号
+type DeviceInstance struct {
+	Instance string // 实例号
+	Hostname string // 主机名
+	FullUrl  string // 完整路径
+}
+
+// Reprovision 重新申请设备码
+type Reprovision struct {
+	Device   string // 目标设备路径（FullUrl）
+	Instance string // 目标实例号，设备码重复时用于区分，为空不校验
+	Restart  bool   // 完成后是否退出，由守护进程重启后生效
+}
+
+// DeviceGrant 根路由分配的设备码和设备凭证
+type DeviceGrant struct {
+	DeviceId   string // 设备码
+	Credential string // 设备凭证，根路由未开启签发时为空
+}
+
+// ToDeviceGrant 解析分配结果，兼容旧版本根路由只返回设备码
+func ToDeviceGrant(content any) DeviceGrant {
+	if id, ok := content.(string); ok {
+		return DeviceGrant{DeviceId: id}
+	}
+	grant := DeviceGrant{}
+	js, err := json.Marshal(content)
+	if err == nil {
+		_ = json.Unmarshal(js, &grant)
+	}
+	return grant
+}
+
+// CredentialRecord 根路由签发的设备凭证，只保存摘要
+type CredentialRecord struct {
+	DeviceId string           // 设备码
+	Hash     string           // 当前凭证的摘要
+	PrevHash string           // 更换前凭证的摘要，更换后短时间内仍有效
+	Time     qdefine.DateTime // 签发时间
+}
+
+// CredentialCheck 设备凭证校验
+type CredentialCheck struct {
+	DeviceId   string // 设备码
+	Credential string // 设备凭证
+}
+
+// SignedMessage 路由间签名的消息，Body为原始JSON文本，避免转换后签名不一致
+type SignedMessage struct {
+	Id    string // 签名设备的设备码
+	Route string // 路由名称
+	Time  int64  // 签名时间（毫秒）
+	Nonce string // 随机数，防止重放
+	Body  string // 消息内容JSON
+	Sig   string // Ed25519签名，base64
+}
+
+// Payload 参与签名的内容
+func (m SignedMessage) Payload() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%d\n%s\n%s", m.Route, m.Id, m.Time, m.Nonce, m.Body))
+}
+
+// DeviceKey 设备签名公钥登记
+type DeviceKey struct {
+	DeviceId   string // 设备码
+	PublicKey  string // Ed25519公钥，base64
+	Credential string // 设备凭证，更换已登记的公钥时需要
+}
+
+// UplinkState 当前使用的上级Broker及连接状态
+type UplinkState struct {
+	Addr      string           // 上级Broker地址，未配置时为空
+	Priority  int              // 优先级
+	Since     qdefine.DateTime // 切换到该Broker的时间
+	Switches  int              // 切换次数
+	Linked    bool             // 是否已连接
+	LinkSince qdefine.DateTime // 连接状态最后变化的时间
+	Uptime    int64            // 本次连接的持续时间（秒）
+	Flaps     int              // 连接断开次数
+}
+
+// DeviceProfile 设备名称和描述编辑
+type DeviceProfile struct {
+	Device string // 目标设备路径（FullUrl）
+	Name   string // 设备名称
+	Desc   string // 设备描述
+}
+
+// DeviceTags 设备标签编辑
+type DeviceTags struct {
+	Device string            // 目标设备路径（FullUrl）
+	Tags   map[string]string // 新的标签，值为空表示删除配置中的标签
+}
+
+// BroadcastRequest 按筛选条件向多个设备发送请求
+type BroadcastRequest struct {
+	Filter  DeviceFilter // 目标设备
+	Module  string       // 设备上的模块名称
+	Route   string       // 方法名称
+	Content any          // 内容
+}
+
+// BroadcastResult 单个设备的请求结果
+type BroadcastResult struct {
+	Device string // 设备路径
+	Result any    // 返回内容
+	Error  string // 失败原因
 }
 
 // ModuleCollection 模块列表
@@ -29,11 +234,34 @@ type ModuleCollection []ModuleInfo
 
 func (c *ModuleCollection) Add(list []ModuleInfo) {
 	for _, nm := range list {
+		// 模块直接敲门时没有状态，视为运行中；下级路由转发的保留原状态
+		if nm.Status == "" {
+			nm.Status = EModuleRunning
+			nm.LastSeen = qdefine.NewDateTime(time.Now())
+		}
+		if nm.VerSince == 0 {
+			nm.VerSince = qdefine.NewDateTime(time.Now())
+		}
 		exist := false
 		for i, om := range *c {
 			if om.Name == nm.Name {
+				// 记录版本变化前的版本
+				if nm.PrevVersion == "" {
+					nm.PrevVersion = om.PrevVersion
+					if om.Version != nm.Version {
+						nm.PrevVersion = om.Version
+					}
+				}
+				// 版本未变化时保留原来的时间
+				if om.Version == nm.Version && om.VerSince != 0 && om.VerSince < nm.VerSince {
+					nm.VerSince = om.VerSince
+				}
 				(*c)[i].Desc = nm.Desc
 				(*c)[i].Version = nm.Version
+				(*c)[i].PrevVersion = nm.PrevVersion
+				(*c)[i].VerSince = nm.VerSince
+				(*c)[i].Status = nm.Status
+				(*c)[i].LastSeen = nm.LastSeen
 				exist = true
 				break
 			}
@@ -44,6 +272,37 @@ func (c *ModuleCollection) Add(list []ModuleInfo) {
 	}
 }
 
+// CompareVersion 比较版本号，如V1.2.0，返回-1、0、1
+func CompareVersion(a, b string) int {
+	as := strings.Split(strings.TrimLeft(a, "vV"), ".")
+	bs := strings.Split(strings.TrimLeft(b, "vV"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		av, bv := "0", "0"
+		if i < len(as) {
+			av = as[i]
+		}
+		if i < len(bs) {
+			bv = bs[i]
+		}
+		an, aErr := strconv.Atoi(av)
+		bn, bErr := strconv.Atoi(bv)
+		if aErr != nil || bErr != nil {
+			// 非数字部分按字符串比较
+			if c := strings.Compare(av, bv); c != 0 {
+				return c
+			}
+			continue
+		}
+		if an != bn {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
 // DeviceAlarm 设备报警信息
 type DeviceAlarm struct {
 	Id      string // 设备码
@@ -119,15 +378,334 @@ type Item struct {
 
 // ModuleInfo 模块信息
 type ModuleInfo struct {
-	Name    string // 模块名称
-	Desc    string // 模块描述
-	Version string // 模块版本
-	Error   string // 详细错误信息（从文件中读取）
+	Name        string           // 模块名称
+	Desc        string           // 模块描述
+	Version     string           // 模块版本
+	PrevVersion string           // 版本变化前的版本
+	VerSince    qdefine.DateTime // 当前版本首次敲门的时间
+	Status      EModuleStatus    // 运行状态
+	LastSeen    qdefine.DateTime // 最后一次敲门或探测到的时间
+	Error       string           // 详细错误信息（从文件中读取）
+}
+
+// ModuleVersion 模块版本清单
+type ModuleVersion struct {
+	Name     string   // 模块名称
+	Version  string   // 模块版本
+	Expected string   // 期望版本，未配置时为空
+	Devices  []string // 运行该版本的设备完整路径
 }
 
+// EModuleStatus 模块运行状态
+type EModuleStatus string
+
+const (
+	EModuleRunning EModuleStatus = "Running" // 运行中
+	EModuleStopped EModuleStatus = "Stopped" // 正常退出
+	EModuleStale   EModuleStatus = "Stale"   // 超时未敲门且探测无响应
+	EModuleCrashed EModuleStatus = "Crashed" // 失联超过崩溃判定时间
+)
+
 // RouteInfo 路由信息
 type RouteInfo struct {
-	Module  string // 模块名称
-	Route   string // 方法名称
-	Content any    // 入参
+	Module  string       // 模块名称
+	Route   string       // 方法名称
+	Content any          // 入参
+	Trace   TraceContext // 追踪信息，跨路由传递
+	Queue   bool         // 目标设备离线时是否排队，等待上线后投递
+	Origin  string       // 请求方设备路径，由首个经过的路由填写
+}
+
+// PendingInfo 排队等待设备上线的请求
+type PendingInfo struct {
+	Id       string           // 排队唯一号
+	DeviceId string           // 等待上线的设备码
+	Time     qdefine.DateTime // 排队时间
+}
+
+// TraceContext 跨路由传递的追踪信息
+type TraceContext struct {
+	TraceId string // 追踪Id，整个请求链路唯一
+	SpanId  string // 上一跳的Id
+}
+
+// TraceSpan 单跳路由的追踪记录
+type TraceSpan struct {
+	TraceId  string    // 追踪Id
+	SpanId   string    // 本跳Id
+	ParentId string    // 上一跳Id
+	RouterId string    // 路由设备码
+	Module   string    // 请求模块
+	Route    string    // 请求方法
+	Start    time.Time // 开始时间
+	Duration int64     // 耗时（微秒）
+	Result   string    // 结果，成功为OK，失败为错误内容
+}
+
+// ERouteErr 路由错误类型
+type ERouteErr string
+
+const (
+	ERouteErrNotFound      ERouteErr = "RouteNotFound"       // 路由或模块未找到
+	ERouteErrDeviceUnknown ERouteErr = "DeviceUnknown"       // 设备未登记
+	ERouteErrDeviceOffline ERouteErr = "DeviceOffline"       // 设备离线
+	ERouteErrTimeout       ERouteErr = "Timeout"             // 请求超时
+	ERouteErrAccessDenied  ERouteErr = "AccessDenied"        // 权限不足
+	ERouteErrUpstream      ERouteErr = "UpstreamUnavailable" // 上级路由不可用
+	ERouteErrRemote        ERouteErr = "RemoteError"         // 目标模块返回的错误
+)
+
+// RouteError 路由请求失败信息，跨路由传递时以Json格式序列化
+type RouteError struct {
+	Code     ERouteErr   // 错误类型
+	DeviceId string      // 失败所在的设备码
+	Message  string      // 错误内容
+	TraceId  string      // 追踪Id
+	Hops     []TraceSpan // 经过的路由，从请求方到失败方
+}
+
+// NewRouteError 创建路由错误
+func NewRouteError(code ERouteErr, devId string, message string) *RouteError {
+	return &RouteError{
+		Code:     code,
+		DeviceId: devId,
+		Message:  message,
+	}
+}
+
+func (e *RouteError) Error() string {
+	if e.DeviceId == "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (%s)", e.Code, e.Message, e.DeviceId)
+}
+
+// Json 序列化为Json，跨路由返回时使用
+func (e *RouteError) Json() string {
+	js, _ := json.Marshal(e)
+	return string(js)
+}
+
+// ErrorContent 响应请求方的错误内容，路由错误以Json返回以便请求方还原
+func ErrorContent(err error) string {
+	var rErr *RouteError
+	if errors.As(err, &rErr) {
+		return rErr.Json()
+	}
+	return err.Error()
+}
+
+// ParseRouteError 从响应内容中还原路由错误，非路由错误的内容视为目标模块返回的错误
+func ParseRouteError(content any, errStr string) *RouteError {
+	str := errStr
+	if s, ok := content.(string); ok && s != "" {
+		str = s
+	} else if content != nil && str == "" {
+		js, _ := json.Marshal(content)
+		str = string(js)
+	}
+	if strings.HasPrefix(str, "{") {
+		e := &RouteError{}
+		if json.Unmarshal([]byte(str), e) == nil && e.Message != "" {
+			return e
+		}
+	}
+	return &RouteError{Code: ERouteErrRemote, Message: str}
+}
+
+// NoticeInterest 通知订阅信息
+type NoticeInterest struct {
+	Id       string   // 订阅方，模块名称或下级路由设备码
+	Router   bool     // 是否为下级路由的汇总订阅
+	Patterns []string // 订阅规则，格式：设备路径/模块名称/通知名称，*匹配一级，**匹配任意级
+}
+
+// NoticeForward 跨路由转发的通知
+type NoticeForward struct {
+	Id      string // 通知唯一号，用于去重
+	From    string // 上一跳路由的设备码
+	Source  string // 通知来源，设备路径/模块名称
+	Route   string // 通知名称
+	Content any    // 通知内容
+}
+
+// QueueItem 离线缓存的上行数据
+type QueueItem struct {
+	Id      uint64           // 序号
+	Time    qdefine.DateTime // 入队时间
+	Module  string           // 目标模块
+	Route   string           // 目标方法
+	Content json.RawMessage  // 内容
+}
+
+// QueueState 离线缓存状态
+type QueueState struct {
+	Count     int              // 当前缓存条数
+	Size      int              // 当前缓存字节数
+	Oldest    qdefine.DateTime // 最早一条的入队时间
+	Dropped   int              // 因超限丢弃的条数
+	Flushing  bool             // 是否正在重发
+	LastFlush qdefine.DateTime // 最后一次重发完成时间
+}
+
+// StreamOpen 打开数据流，续传时使用同一个Id
+type StreamOpen struct {
+	Id        string            // 流唯一号
+	Name      string            // 名称
+	Size      int64             // 总大小
+	ChunkSize int               // 分块大小
+	Source    string            // 发送方设备路径
+	Meta      map[string]string // 附加信息，由上层业务使用
+}
+
+// StreamSend 发送数据流参数，接收方保存到接收目录后发送RouteStreamDone通知
+type StreamSend struct {
+	Device string            // 接收方设备路径（FullUrl）
+	Source string            // 沙箱根目录下的源文件
+	Name   string            // 名称，为空使用源文件名
+	Meta   map[string]string // 附加信息，原样交给接收方
+}
+
+// StreamChunk 数据块
+type StreamChunk struct {
+	Id   string // 流唯一号
+	Seq  int    // 块序号，从0开始
+	Data []byte // 块内容
+	Crc  uint32 // 块内容的CRC32校验
+}
+
+// StreamAck 接收方应答
+type StreamAck struct {
+	Id   string // 流唯一号
+	Next int    // 最小的未收到块序号，发送方从此处续传
+}
+
+// StreamClose 关闭数据流
+type StreamClose struct {
+	Id     string // 流唯一号
+	Sha256 string // 完整内容的SHA-256校验
+}
+
+// StreamState 数据流状态
+type StreamState struct {
+	Id          string           // 流唯一号
+	Name        string           // 名称
+	Peer        string           // 对方设备路径
+	IsSend      bool             // 是否为发送方
+	Size        int64            // 总大小
+	Transferred int64            // 已传输大小
+	Status      string           // 状态：Running、Retrying、Done、Failed
+	Error       string           // 失败原因
+	Time        qdefine.DateTime // 最后更新时间
+}
+
+// FileTransfer 设备间文件传输参数，路径均为沙箱根目录下的相对路径
+type FileTransfer struct {
+	Device string // 对方设备路径（FullUrl）
+	Source string // 源文件
+	Target string // 目标文件
+}
+
+// ExecRequest 远程命令请求
+type ExecRequest struct {
+	Device  string   // 目标设备路径（FullUrl）
+	Command string   // 命令名称，需在目标设备配置的允许列表中
+	Args    []string // 附加参数，需命令配置允许
+	Dir     string   // 工作目录，为空使用命令配置的目录
+	Timeout int      // 超时时间（秒）
+	From    string   // 请求方设备路径，由路由填写
+}
+
+// ExecResult 远程命令结果
+type ExecResult struct {
+	Device    string // 执行的设备路径
+	Command   string // 命令名称
+	ExitCode  int    // 退出码
+	Stdout    string // 标准输出
+	Stderr    string // 错误输出
+	Truncated bool   // 输出是否超出限制被截断
+	Duration  int64  // 耗时（毫秒）
+	Error     string // 无法执行或超时的原因
+}
+
+// ModuleControl 模块启停请求
+type ModuleControl struct {
+	Device string // 目标设备路径（FullUrl）
+	Module string // 模块名称，需在目标设备配置的允许列表中
+	Action string // 操作：Start、Stop、Restart
+	From   string // 请求方设备路径，由路由填写
+}
+
+// ModuleControlResult 模块启停结果
+type ModuleControlResult struct {
+	Device string        // 执行的设备路径
+	Module string        // 模块名称
+	Action string        // 操作
+	Status EModuleStatus // 操作后的模块状态
+}
+
+// UpdateRequest 模块更新请求
+type UpdateRequest struct {
+	Module  string // 模块名称，需在目标设备配置的允许列表中
+	Version string // 新版本
+	Package string // 更新包，目标设备沙箱下的相对路径
+	Rollout string // 分批更新唯一号，备份按此区分，为空时为单独更新
+	From    string // 请求方设备路径，由路由填写
+}
+
+// RolloutPlan 模块分批更新计划
+type RolloutPlan struct {
+	Module        string // 模块名称
+	Version       string // 新版本
+	Package       string // 更新包，根路由沙箱下的相对路径
+	Prefix        string // 目标设备完整路径前缀
+	WaveSize      int    // 每批更新的设备数
+	HealthMinutes int    // 每批更新后的观察时间（分钟）
+}
+
+// RolloutDevice 更新中的设备
+type RolloutDevice struct {
+	Device    string // 设备完整路径
+	Wave      int    // 所在批次，从1开始
+	Status    string // 状态：Pending、Updating、Updated、Failed、RolledBack
+	Error     string // 失败原因
+	Installed bool   // 是否已替换（超时等无法确定时也视为已替换），失败时只回滚这些设备
+}
+
+// RolloutState 分批更新状态
+type RolloutState struct {
+	Id      string           // 唯一号
+	Plan    RolloutPlan      // 更新计划
+	Status  string           // 状态：Running、Done、Failed、RolledBack
+	Wave    int              // 当前批次
+	Devices []RolloutDevice  // 目标设备
+	Time    qdefine.DateTime // 创建时间
+	Error   string           // 失败原因
+}
+
+// AuditRecord 审计记录，统一上报到根路由
+type AuditRecord struct {
+	Time   qdefine.DateTime // 时间
+	Device string           // 执行的设备路径
+	From   string           // 请求方设备路径
+	Action string           // 操作类型
+	Target string           // 操作对象
+	Args   []string         // 参数
+	Result string           // 结果
+}
+
+// LogFile 模块日志文件
+type LogFile struct {
+	Module string           // 模块名称
+	Name   string           // 文件名，相对于日志目录
+	Size   int64            // 文件大小
+	Time   qdefine.DateTime // 最后修改时间
+}
+
+// LogQuery 日志查询参数
+type LogQuery struct {
+	Module string // 模块名称
+	File   string // 文件名，为空时使用最新的文件
+	Lines  int    // 返回最后的行数
+	Filter string // 过滤内容，仅返回包含该内容的行（不区分大小写）
 }
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRouteError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *RouteError
+		text string
+	}{
+		{"带设备", NewRouteError(ERouteErrDeviceOffline, "dev1", "device offline"), "DeviceOffline: device offline (dev1)"},
+		{"无设备", NewRouteError(ERouteErrRemote, "", "bad"), "RemoteError: bad"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err.Error() != tt.text {
+				t.Errorf("Error() = %q, want %q", tt.err.Error(), tt.text)
+			}
+			parsed := ParseRouteError(ErrorContent(tt.err), "")
+			if parsed.Code != tt.err.Code || parsed.DeviceId != tt.err.DeviceId || parsed.Message != tt.err.Message {
+				t.Errorf("ParseRouteError = %+v, want %+v", parsed, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseRouteError(t *testing.T) {
+	tests := []struct {
+		name    string
+		content any
+		errStr  string
+		code    ERouteErr
+		message string
+	}{
+		{"普通错误", nil, "file not find", ERouteErrRemote, "file not find"},
+		{"内容优先", "module busy", "ignored", ERouteErrRemote, "module busy"},
+		{"路由错误", `{"Code":"Timeout","DeviceId":"d","Message":"request timeout"}`, "", ERouteErrTimeout, "request timeout"},
+		{"非路由Json", `{"Other":1}`, "", ERouteErrRemote, `{"Other":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := ParseRouteError(tt.content, tt.errStr)
+			if e.Code != tt.code || e.Message != tt.message {
+				t.Errorf("ParseRouteError = %+v, want %s %q", e, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+func TestErrorContent(t *testing.T) {
+	if ErrorContent(errors.New("plain")) != "plain" {
+		t.Errorf("plain error should keep its text")
+	}
+}
+
+func TestCompareVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"V1.2.0", "V1.2.0", 0},
+		{"V1.2.0", "v1.2", 0},
+		{"V1.2.0", "V1.10.0", -1},
+		{"V2.0.0", "V1.99.99", 1},
+		{"1.0.1", "V1.0.0", 1},
+		{"V1.0.0-beta", "V1.0.0-rc", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"|"+tt.b, func(t *testing.T) {
+			if got := CompareVersion(tt.a, tt.b); got != tt.want {
+				t.Errorf("CompareVersion(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceFilterMatch(t *testing.T) {
+	tags := map[string]string{"site": "sh", "role": "edge"}
+	tests := []struct {
+		name    string
+		filter  DeviceFilter
+		fullUrl string
+		want    bool
+	}{
+		{"空条件", DeviceFilter{}, "root/a/b", true},
+		{"前缀相同", DeviceFilter{Prefix: "root/a"}, "root/a", true},
+		{"下级设备", DeviceFilter{Prefix: "root/a"}, "root/a/b", true},
+		{"结尾斜杠", DeviceFilter{Prefix: "root/a/"}, "root/a/b", true},
+		{"不按字符匹配", DeviceFilter{Prefix: "root/a"}, "root/ab", false},
+		{"其他分支", DeviceFilter{Prefix: "root/a"}, "root/b/a", false},
+		{"标签匹配", DeviceFilter{Tags: map[string]string{"site": "sh"}}, "root/a", true},
+		{"标签不匹配", DeviceFilter{Tags: map[string]string{"site": "bj"}}, "root/a", false},
+		{"缺少标签", DeviceFilter{Tags: map[string]string{"line": "1"}}, "root/a", false},
+		{"前缀和标签", DeviceFilter{Prefix: "root", Tags: map[string]string{"role": "edge", "site": "sh"}}, "root/a", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.fullUrl, tags); got != tt.want {
+				t.Errorf("Match(%q) = %v, want %v", tt.fullUrl, got, tt.want)
+			}
+		})
+	}
+}